@@ -5,11 +5,9 @@ import (
 	"encoding/xml"
 	"flag"
 	"fmt"
-	"go/ast"
-	"go/parser"
-	"go/token"
 	"io"
 	"os"
+	"path"
 	"regexp"
 	"sort"
 	"strconv"
@@ -19,9 +17,40 @@ import (
 type command struct {
 	originalLine string
 	endLine      string
-	lineNo       int
-	fields       []string
-	subCommands  []command
+	// comment is the comment at the end of the input line, without
+	// the semicolon.
+	comment string
+	// lineNo is the input line the command came from, or noLine if
+	// it was made up by the compiler.
+	lineNo int
+	// label is the name of the label the command was generated for
+	// in timeline mode.
+	label       string
+	fields      []string
+	subCommands []command
+}
+
+const noLine = -1
+
+// origin describes where a command came from.
+func (c *command) origin() string {
+	switch {
+	case c.lineNo == noLine && c.label == "":
+		return "generated"
+	case c.lineNo == noLine:
+		return fmt.Sprintf("label `%s`", c.label)
+	case c.label == "":
+		return fmt.Sprintf("line %d", c.lineNo+1)
+	}
+	return fmt.Sprintf("line %d for label `%s`", c.lineNo+1, c.label)
+}
+
+// setLabel sets the label commands were generated for.
+func setLabel(cs []command, labelName string) {
+	for i := range cs {
+		cs[i].label = labelName
+		setLabel(cs[i].subCommands, labelName)
+	}
 }
 
 func (c command) line() string {
@@ -38,10 +67,15 @@ func (c *command) setFields(fields []string) {
 
 type program []command
 
+// errorExit stops compiling with an error in the given line.
 func errorExit(lineNo int, format string, args ...interface{}) {
 	args = append([]interface{}{lineNo + 1}, args...)
-	fmt.Fprintf(os.Stderr, "Error in line %d: "+format+"\n", args...)
-	os.Exit(1)
+	panic(compileError{fmt.Sprintf("Error in line %d: "+format, args...)})
+}
+
+func warn(lineNo int, format string, args ...interface{}) {
+	args = append([]interface{}{lineNo + 1}, args...)
+	fmt.Fprintf(os.Stderr, "Warning in line %d: "+format+"\n", args...)
 }
 
 func parseNumber(f string, lineNo int) int {
@@ -60,6 +94,15 @@ func parseCount(f string, lineNo int) int {
 	return duration
 }
 
+// lineComment returns the comment in a line, if it has one.
+func lineComment(lineVerbatim string) string {
+	i := strings.Index(lineVerbatim, ";")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(lineVerbatim[i+1:])
+}
+
 func splitLine(lineVerbatim string) []string {
 	line := lineVerbatim
 	if strings.Contains(line, ";") {
@@ -89,7 +132,7 @@ func parseLines(lines []string, startLineNo int) (commands []command, lineNo int
 }
 
 func isBlockCommand(c string) bool {
-	return c == "L" || c == "CLUBS" || c == "FILL"
+	return c == "L" || c == "CLUBS" || c == "FILL" || c == "EACH" || c == "AT"
 }
 
 func (c *command) hasSubCommands() bool {
@@ -99,7 +142,7 @@ func (c *command) hasSubCommands() bool {
 func parseCommand(lines []string, startLineNo int, fields []string) (c command, lineNo int) {
 	lineNo = startLineNo
 	lineVerbatim := lines[lineNo]
-	c = command{originalLine: lineVerbatim, lineNo: lineNo, fields: fields}
+	c = command{originalLine: lineVerbatim, comment: lineComment(lineVerbatim), lineNo: lineNo, fields: fields}
 	if fields[0] == "E" {
 		panic("cannot parse command E")
 	}
@@ -137,6 +180,14 @@ func (c *command) duration() int {
 		return duration * count
 	case "FILL":
 		return parseCount(c.fields[1], c.lineNo)
+	case "CLUBS":
+		return commandsDuration(c.subCommands)
+	case "GRADIENT":
+		return parseCount(c.fields[3], c.lineNo)
+	case "CHASE", "WAVE":
+		return parseCount(c.fields[4], c.lineNo)
+	case "RANDOM":
+		return parseCount(c.fields[len(c.fields)-1], c.lineNo)
 	case "TIME":
 		errorExit(c.lineNo, "TIME not supported here")
 		return -1
@@ -148,48 +199,67 @@ func (c *command) duration() int {
 	}
 }
 
-func (c *command) print(w io.Writer) {
-	fmt.Fprintln(w, c.line())
-	if c.hasSubCommands() {
-		for _, sc := range c.subCommands {
-			sc.print(w)
-		}
-		fmt.Println(c.endLine)
+// sharedDuration is how much a command moves the time for all clubs.
+// Only some clubs run a `CLUBS` block, so it doesn't move the time for
+// the others, and within the block it's up to `TIME` to get back in
+// sync.  Once the program is specialized for a club, that's the same
+// as the duration.
+func (c *command) sharedDuration() int {
+	switch c.fields[0] {
+	case "CLUBS":
+		return 0
+	case "L":
+		return parseCount(c.fields[1], c.lineNo) * commandsSharedDuration(c.subCommands)
 	}
+	return c.duration()
 }
 
-func (p program) print(w io.Writer) {
-	for _, c := range p {
-		c.print(w)
+func commandsSharedDuration(cs []command) int {
+	duration := 0
+	for _, sc := range cs {
+		duration += sc.sharedDuration()
 	}
+	return duration
 }
 
-func (p program) annotateTimes(w io.Writer) {
-	time := 0
+func (p program) uses(name string) bool {
 	for _, c := range p {
-		c.print(w)
-		d := c.duration()
-		if d > 0 {
-			time += c.duration()
-			fmt.Fprintf(w, "    ; time %d\n", time)
+		if c.fields[0] == name || program(c.subCommands).uses(name) {
+			return true
 		}
 	}
+	return false
 }
 
-func (p program) specializeForClub(club int) program {
+// specializeForClub picks the commands for one club.  If club is zero
+// the program stays the same for all clubs, with the clubs of `CLUBS`
+// blocks listed by number.  It runs before anything in the blocks is
+// evaluated, so the blocks of other clubs don't need to make sense for
+// this one.
+func (p program) specializeForClub(club int, clubs int, groups map[string]clubSelector) program {
 	var newCommands []command
 	for _, c := range p {
 		switch c.fields[0] {
+		case "GROUP":
+			continue
 		case "CLUBS":
-			found := false
-			for _, f := range c.fields[1:len(c.fields)] {
-				if parseCount(f, c.lineNo) == club {
-					found = true
-					break
+			selector := parseClubSelectors(c.fields[1:len(c.fields)], groups, c.lineNo)
+			if club == 0 {
+				newC := c
+				fields := []string{"CLUBS"}
+				for _, m := range selector.members(clubs, c.lineNo) {
+					fields = append(fields, strconv.Itoa(m))
 				}
-			}
-			if found {
-				subCommands := program(c.subCommands).specializeForClub(club)
+				if len(fields) == 1 {
+					continue
+				}
+				if strings.Join(fields, ",") != strings.Join(c.fields, ",") {
+					newC.setFields(fields)
+				}
+				newC.subCommands = program(c.subCommands).specializeForClub(club, clubs, groups)
+				newCommands = append(newCommands, newC)
+			} else if selector.matches(club) {
+				subCommands := program(c.subCommands).specializeForClub(club, clubs, groups)
 				for _, sc := range subCommands {
 					newCommands = append(newCommands, sc)
 				}
@@ -197,7 +267,7 @@ func (p program) specializeForClub(club int) program {
 		default:
 			newC := c
 			if c.hasSubCommands() {
-				newC.subCommands = program(c.subCommands).specializeForClub(club)
+				newC.subCommands = program(c.subCommands).specializeForClub(club, clubs, groups)
 			}
 			newCommands = append(newCommands, newC)
 		}
@@ -205,27 +275,82 @@ func (p program) specializeForClub(club int) program {
 	return newCommands
 }
 
-func (p program) resolveTime() program {
+// timePolicy says what to do with a `TIME` that lies before the
+// current time.
+type timePolicy int
+
+const (
+	timePolicyError timePolicy = iota
+	timePolicyClip
+	timePolicySkip
+)
+
+var timePolicies = map[string]timePolicy{
+	"error": timePolicyError,
+	"clip":  timePolicyClip,
+	"skip":  timePolicySkip,
+}
+
+// resolveTimeInCommands turns `TIME`s into `D`s, given that cs starts
+// at the absolute time start.  It returns the time at which cs ends.
+// `TIME` can be used within `CLUBS` and `FILL`, but not in loops, where
+// every iteration would have to arrive at the same time.
+func resolveTimeInCommands(cs []command, start int, policy timePolicy) ([]command, int) {
 	var newCommands []command
-	time := 0
-	for _, c := range p {
+	time := start
+	for _, c := range cs {
 		switch c.fields[0] {
 		case "TIME":
 			target := parseCount(c.fields[1], c.lineNo)
 			if target < time {
-				errorExit(c.lineNo, "Cannot go back in time - it's already %d", time)
+				switch policy {
+				case timePolicyClip:
+					if target < start {
+						errorExit(c.lineNo, "Cannot go back in time to before the start of the block at %d", start)
+					}
+					warn(c.lineNo, "Clipping the commands before TIME %d, which is %d before the current time %d", target, time-target, time)
+					newCommands = clipCommands(newCommands, target-start, c)
+					time = target
+				case timePolicySkip:
+					warn(c.lineNo, "Skipping TIME %d, which is %d before the current time %d", target, time-target, time)
+				default:
+					errorExit(c.lineNo, "Cannot go back in time - it's already %d", time)
+				}
+				continue
 			}
 			if target == time {
 				continue
 			}
 			fields := []string{"D", fmt.Sprintf("%d", target-time)}
-			newCommands = append(newCommands, command{fields: fields, lineNo: c.lineNo})
+			newCommands = append(newCommands, command{fields: fields, lineNo: c.lineNo, label: c.label, comment: c.comment})
 			time = target
+		case "L":
+			if program(c.subCommands).uses("TIME") {
+				errorExit(c.lineNo, "TIME not supported in loops")
+			}
+			newCommands = append(newCommands, c)
+			time += c.sharedDuration()
+		case "FILL":
+			newC := c
+			newC.subCommands, _ = resolveTimeInCommands(c.subCommands, time, policy)
+			newCommands = append(newCommands, newC)
+			time += newC.sharedDuration()
+		case "CLUBS":
+			// Every `CLUBS` block starts at the current time, for the
+			// clubs it applies to.
+			newC := c
+			newC.subCommands, _ = resolveTimeInCommands(c.subCommands, time, policy)
+			newCommands = append(newCommands, newC)
 		default:
 			newCommands = append(newCommands, c)
-			time += c.duration()
+			time += c.sharedDuration()
 		}
 	}
+	return newCommands, time
+}
+
+func (p program) resolveTime(policy timePolicy) program {
+	newCommands, _ := resolveTimeInCommands(p, 0, policy)
 	return newCommands
 }
 
@@ -239,17 +364,37 @@ func (c color) fields() []string {
 	return []string{fmt.Sprintf("%d", c.r), fmt.Sprintf("%d", c.g), fmt.Sprintf("%d", c.b)}
 }
 
-func lookupColor(colors map[string]color, description string) (bool, color, string) {
+func matchColorDescription(description string) []string {
 	if colorRegexp == nil {
 		colorRegexp = regexp.MustCompile("^([^%]+)(\\s+(\\d+)%)?$")
 	}
-	matches := colorRegexp.FindStringSubmatch(description)
+	return colorRegexp.FindStringSubmatch(description)
+}
+
+func lookupColor(colors map[string]color, description string) (bool, color, string) {
+	matches := matchColorDescription(description)
+	if matches == nil {
+		return false, color{}, ""
+	}
 	name := strings.ToLower(matches[1])
 	c, ok := colors[name]
 	return ok, c, matches[3]
 }
 
-func resolveColor(colors map[string]color, description string, lineNo int) []string {
+// splitColorDescription splits a color description like `red 50%` into
+// the name and the percentage, which is 100 if none is given.
+func splitColorDescription(description string, lineNo int) (string, int) {
+	matches := matchColorDescription(description)
+	if matches == nil {
+		errorExit(lineNo, "Incorrect color `%s`", description)
+	}
+	if matches[3] == "" {
+		return matches[1], 100
+	}
+	return matches[1], parseNumber(matches[3], lineNo)
+}
+
+func resolveColorValue(colors map[string]color, description string, lineNo int) color {
 	ok, c, pString := lookupColor(colors, description)
 	if !ok {
 		errorExit(lineNo, "Color `%s` not defined", description)
@@ -260,7 +405,59 @@ func resolveColor(colors map[string]color, description string, lineNo int) []str
 		c.g = int(float64(c.g) * p)
 		c.b = int(float64(c.b) * p)
 	}
-	return c.fields()
+	return c
+}
+
+func resolveColor(colors map[string]color, description string, lineNo int) []string {
+	return resolveColorValue(colors, description, lineNo).fields()
+}
+
+func gradientCommands(c command, colors map[string]color) []command {
+	if len(c.fields) != 5 && len(c.fields) != 6 {
+		errorExit(c.lineNo, "GRADIENT needs two colors, a duration, a number of steps and optionally a color space")
+	}
+
+	from := resolveColorValue(colors, c.fields[1], c.lineNo)
+	to := resolveColorValue(colors, c.fields[2], c.lineNo)
+	duration := parseCount(c.fields[3], c.lineNo)
+	steps := parseCount(c.fields[4], c.lineNo)
+	if duration < 0 {
+		errorExit(c.lineNo, "GRADIENT can't have a negative duration")
+	}
+	if steps < 0 {
+		errorExit(c.lineNo, "GRADIENT can't have a negative number of steps")
+	}
+	if steps > duration {
+		errorExit(c.lineNo, "GRADIENT can't have more steps than its duration")
+	}
+
+	space := "oklab"
+	if len(c.fields) == 6 {
+		space = strings.ToLower(c.fields[5])
+	}
+	interpolate, ok := colorSpaces[space]
+	if !ok {
+		errorExit(c.lineNo, "Unknown color space `%s`", c.fields[5])
+	}
+
+	commands := []command{{fields: append([]string{"C"}, from.fields()...), lineNo: c.lineNo}}
+	timeSoFar := 0
+	for i := 1; i <= steps; i++ {
+		time := i*duration/steps - timeSoFar
+		clr := interpolate(from, to, float64(i)/float64(steps))
+
+		fields := append([]string{"RAMP"}, clr.fields()...)
+		fields = append(fields, strconv.FormatInt(int64(time), 10))
+		commands = append(commands, command{fields: fields, lineNo: c.lineNo})
+
+		timeSoFar += time
+	}
+
+	if timeSoFar != duration {
+		panic("I can't do gradient math")
+	}
+
+	return commands
 }
 
 func resolveColorInCommands(cs []command, colors map[string]color, allowDefine bool) []command {
@@ -285,6 +482,8 @@ func resolveColorInCommands(cs []command, colors map[string]color, allowDefine b
 				newC.setFields([]string{"RAMP", clr[0], clr[1], clr[2], c.fields[2]})
 			}
 			newCommands = append(newCommands, newC)
+		case "GRADIENT":
+			newCommands = append(newCommands, gradientCommands(c, colors)...)
 		default:
 			newC := c
 			if c.hasSubCommands() {
@@ -371,78 +570,123 @@ func (p program) gatherSubs() map[string]sub {
 }
 
 type label struct {
-	name   string
-	fields []string
-	start  int
-	end    int
+	name string
+	// timelineName, if set, is used instead of name in timeline mode.
+	timelineName string
+	start        int
+	end          int
+	// beat is whether the label was made by beat detection, rather
+	// than coming from Audacity.
+	beat bool
 }
 
-func cannotInterpret(expr ast.Expr, lineNo int) {
-	errorExit(lineNo, "Cannot interpret %T expression `%v`", expr, expr)
+// occurrence picks the label at the given index from all labels with
+// the same name, sorted by their start.  If the index is negative
+// there must be only one.
+func occurrence(ls []label, name string, index int) (label, error) {
+	if len(ls) == 0 {
+		return label{}, fmt.Errorf("Unknown label `%s`", name)
+	}
+	if index < 0 {
+		if len(ls) > 1 {
+			return label{}, fmt.Errorf("Label `%s` occurs %d times, so it needs an index from `%s[0]` to `%s[%d]`", name, len(ls), name, name, len(ls)-1)
+		}
+		return ls[0], nil
+	}
+	if index >= len(ls) {
+		return label{}, fmt.Errorf("Label `%s` only occurs %d times", name, len(ls))
+	}
+	return ls[index], nil
 }
 
-func lookupLabel(labels map[string]label, name string, lineNo int) label {
-	label, ok := labels[name]
-	if !ok {
-		errorExit(lineNo, "Unknown label `%s`", name)
+var labelIndexRegexp = regexp.MustCompile("^(.*?)\\s*\\[\\s*(\\d+)\\s*\\]$")
+
+// lookupLabel looks up a label ignoring case, the same way we do with
+// colors.  `name[i]` picks one of several labels with the same name.
+func lookupLabel(labels map[string][]label, name string, lineNo int) label {
+	index := -1
+	matches := labelIndexRegexp.FindStringSubmatch(name)
+	if matches != nil {
+		name = matches[1]
+		index = parseNumber(matches[2], lineNo)
+	}
+	l, err := occurrence(labels[strings.ToLower(name)], name, index)
+	if err != nil {
+		errorExit(lineNo, "%s", err.Error())
 	}
-	return label
+	return l
 }
 
-func interpretExpr(expr ast.Expr, labels map[string]label, definitions map[string]int, lineNo int) int {
-	switch expr := expr.(type) {
-	case *ast.BasicLit:
-		if expr.Kind == token.INT {
-			return parseNumber(expr.Value, lineNo)
+func (c *command) exprFields() []int {
+	switch c.fields[0] {
+	case "D", "TIME", "RAMP", "L", "FILL":
+		return []int{len(c.fields) - 1}
+	case "GRADIENT":
+		if len(c.fields) < 4 {
+			errorExit(c.lineNo, "GRADIENT without duration")
 		}
-	case *ast.Ident:
-		v, ok := definitions[expr.Name]
-		if ok {
-			return v
+		return []int{3}
+	case "CHASE", "WAVE":
+		if len(c.fields) != 5 {
+			errorExit(c.lineNo, "%s needs clubs, a color, a step and a duration", c.fields[0])
 		}
-		return lookupLabel(labels, expr.Name, lineNo).start
-	case *ast.UnaryExpr:
-		if expr.Op == token.SUB {
-			ident, ok := expr.X.(*ast.Ident)
-			if !ok {
-				cannotInterpret(expr, lineNo)
-			}
-			return lookupLabel(labels, ident.Name, lineNo).end
-		} else if expr.Op == token.AND {
-			ident, ok := expr.X.(*ast.Ident)
-			if !ok {
-				cannotInterpret(expr, lineNo)
-			}
-			label := lookupLabel(labels, ident.Name, lineNo)
-			return label.end - label.start
+		return []int{3, 4}
+	case "ENVELOPE":
+		if len(c.fields) < 4 {
+			errorExit(c.lineNo, "ENVELOPE without resolution")
 		}
-	case *ast.BinaryExpr:
-		if expr.Op == token.QUO {
-			left := interpretExpr(expr.X, labels, definitions, lineNo)
-			right := interpretExpr(expr.Y, labels, definitions, lineNo)
-			return left / right
+		return []int{3}
+	case "RANDOM":
+		if len(c.fields) < 5 {
+			errorExit(c.lineNo, "RANDOM needs a seed, colors, a step and a duration")
 		}
+		return []int{len(c.fields) - 2, len(c.fields) - 1}
+	}
+	return nil
+}
+
+func (c *command) isPick() bool {
+	return (c.fields[0] == "C" || c.fields[0] == "RAMP") && len(c.fields) > 1 && strings.ToUpper(c.fields[1]) == "PICK"
+}
+
+// resolvePick replaces `PICK,index,color1,...,colorN` in a `C` or
+// `RAMP` with the color at the given index.  The index counts from 1
+// and wraps around, so `PICK,club,red,green` alternates between red
+// and green from club to club.
+func (c command) resolvePick(labels map[string][]label, definitions map[string]int) command {
+	last := len(c.fields)
+	if c.fields[0] == "RAMP" {
+		last--
+	}
+	if last < 4 {
+		errorExit(c.lineNo, "PICK needs an index and at least one color")
 	}
-	cannotInterpret(expr, lineNo)
-	return -1
+
+	choices := c.fields[3:last]
+	index := evalExpr(c.fields[2], labels, definitions, c.lineNo) - 1
+	index = (index%len(choices) + len(choices)) % len(choices)
+
+	newC := c
+	newC.setFields(append([]string{c.fields[0], choices[index]}, c.fields[last:len(c.fields)]...))
+	return newC
 }
 
-func (p program) resolveExprs(labels map[string]label, definitions map[string]int) program {
+func (p program) resolveExprs(labels map[string][]label, definitions map[string]int) program {
 	var newCommands []command
 	for _, c := range p {
+		if c.isPick() {
+			c = c.resolvePick(labels, definitions)
+		}
 		newC := c
-		if c.fields[0] == "D" || c.fields[0] == "TIME" || c.fields[0] == "RAMP" || c.fields[0] == "L" || c.fields[0] == "FILL" {
-			exprField := len(c.fields) - 1
+		exprFields := c.exprFields()
+		if len(exprFields) > 0 {
 			newC.setFields(make([]string, len(c.fields)))
 			copy(newC.fields, c.fields)
 
-			expr, err := parser.ParseExpr(c.fields[exprField])
-			if err != nil {
-				errorExit(c.lineNo, "Parse error: %s", err.Error())
+			for _, i := range exprFields {
+				result := evalExpr(c.fields[i], labels, definitions, c.lineNo)
+				newC.fields[i] = strconv.FormatInt(int64(result), 10)
 			}
-			result := interpretExpr(expr, labels, definitions, c.lineNo)
-
-			newC.fields[exprField] = strconv.FormatInt(int64(result), 10)
 		}
 		if c.hasSubCommands() {
 			newC.subCommands = program(c.subCommands).resolveExprs(labels, definitions)
@@ -487,7 +731,7 @@ func (c command) fill(duration int) []command {
 
 	left := duration - loopDuration*numIterations
 	if left > 0 {
-		newCommands = append(newCommands, fillCommands(c.subCommands, left)...)
+		newCommands = append(newCommands, fillCommands(c.subCommands, left, c)...)
 	}
 
 	if commandsDuration(newCommands) != duration {
@@ -497,7 +741,9 @@ func (c command) fill(duration int) []command {
 	return newCommands
 }
 
-func fillCommands(commands []command, duration int) []command {
+// fillCommands fills duration with commands, shortening them or adding
+// a `D` at the end, which is attributed to c.
+func fillCommands(commands []command, duration int, c command) []command {
 	var newCommands []command
 	time := 0
 	for _, sc := range commands {
@@ -523,7 +769,7 @@ func fillCommands(commands []command, duration int) []command {
 		panic("I can't do fill math")
 	}
 	if left > 0 {
-		newCommands = append(newCommands, command{fields: []string{"D", strconv.FormatInt(int64(left), 10)}})
+		newCommands = append(newCommands, command{fields: []string{"D", strconv.FormatInt(int64(left), 10)}, lineNo: c.lineNo, label: c.label, comment: c.comment})
 	}
 	if commandsDuration(newCommands) != duration {
 		//fmt.Fprintf(os.Stderr, "duration %d should be %d\n", commandsDuration(newCommands), duration)
@@ -533,6 +779,136 @@ func fillCommands(commands []command, duration int) []command {
 	return newCommands
 }
 
+// clipCommands shortens commands that take longer than duration at
+// their end, going by the time they take for all clubs.  Commands at
+// the very end that don't take any time, like setting a color, are
+// kept.  c is the `TIME` we clip for.
+func clipCommands(commands []command, duration int, c command) []command {
+	end := len(commands)
+	for end > 0 && commands[end-1].sharedDuration() == 0 {
+		end--
+	}
+
+	var newCommands []command
+	time := 0
+	for _, sc := range commands[0:end] {
+		left := duration - time
+		if left <= 0 {
+			break
+		}
+		scDuration := sc.sharedDuration()
+		if scDuration <= left {
+			newCommands = append(newCommands, sc)
+			time += scDuration
+			continue
+		}
+		newCommands = append(newCommands, clipCommand(sc, left, c)...)
+		time = duration
+	}
+	return append(newCommands, commands[end:len(commands)]...)
+}
+
+// clipCommand shortens a command to take duration.  Loops are cut
+// after the last iteration that fits, followed by what fits of the
+// next one.
+func clipCommand(sc command, duration int, c command) []command {
+	switch sc.fields[0] {
+	case "D", "RAMP", "FILL":
+		fields := make([]string, len(sc.fields))
+		copy(fields, sc.fields)
+		fields[len(fields)-1] = strconv.Itoa(duration)
+		newC := sc
+		newC.setFields(fields)
+		return []command{newC}
+	case "L":
+		var newCommands []command
+		bodyDuration := commandsSharedDuration(sc.subCommands)
+		if iterations := duration / bodyDuration; iterations > 0 {
+			newC := sc
+			newC.setFields([]string{"L", strconv.Itoa(iterations)})
+			newCommands = append(newCommands, newC)
+		}
+		if left := duration % bodyDuration; left > 0 {
+			newCommands = append(newCommands, clipCommands(sc.subCommands, left, c)...)
+		}
+		return newCommands
+	}
+	errorExit(c.lineNo, "Can't clip `%s` from line %d to get to TIME %s", sc.fields[0], sc.lineNo+1, c.fields[1])
+	return nil
+}
+
+// matchLabels returns all labels whose names match a pattern, sorted
+// by start.  The pattern is either a glob like `verse*`, or a regular
+// expression between slashes, like `/^(eins|zwei)$/`.  Case doesn't
+// matter in either.
+func matchLabels(labels map[string][]label, pattern string, lineNo int) []label {
+	var matches func(name string) bool
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			errorExit(lineNo, "Invalid regular expression `%s`: %s", pattern, err.Error())
+		}
+		matches = re.MatchString
+	} else {
+		glob := strings.ToLower(pattern)
+		if _, err := path.Match(glob, ""); err != nil {
+			errorExit(lineNo, "Invalid pattern `%s`", pattern)
+		}
+		matches = func(name string) bool {
+			ok, _ := path.Match(glob, name)
+			return ok
+		}
+	}
+
+	var matched []label
+	for name, ls := range labels {
+		if matches(name) {
+			matched = append(matched, ls...)
+		}
+	}
+	sort.Stable(timeline(matched))
+	return matched
+}
+
+// resolveEach expands `EACH,<pattern>` blocks, and their alias `AT`,
+// into a `TIME` to the start of every label matching the pattern,
+// followed by the block's body.  In the body, `start`, `end` and
+// `duration` are defined for the label, and `index` counts the labels
+// from 0.
+func (p program) resolveEach(labels map[string][]label, definitions map[string]int) program {
+	var newCommands []command
+	for _, c := range p {
+		if c.fields[0] != "EACH" && c.fields[0] != "AT" {
+			newC := c
+			if c.hasSubCommands() {
+				newC.subCommands = program(c.subCommands).resolveEach(labels, definitions)
+			}
+			newCommands = append(newCommands, newC)
+			continue
+		}
+
+		if len(c.fields) != 2 {
+			errorExit(c.lineNo, "%s needs a label pattern", c.fields[0])
+		}
+		matched := matchLabels(labels, c.fields[1], c.lineNo)
+		if len(matched) == 0 {
+			errorExit(c.lineNo, "No labels match `%s`", c.fields[1])
+		}
+		for i, l := range matched {
+			eachDefinitions := map[string]int{"start": l.start, "end": l.end, "duration": l.end - l.start, "index": i}
+			for name, v := range definitions {
+				if _, ok := eachDefinitions[name]; !ok {
+					eachDefinitions[name] = v
+				}
+			}
+			body := program(c.subCommands).resolveEach(labels, eachDefinitions).resolveExprs(labels, eachDefinitions)
+			newCommands = append(newCommands, command{fields: []string{"TIME", strconv.Itoa(l.start)}, lineNo: c.lineNo})
+			newCommands = append(newCommands, body...)
+		}
+	}
+	return newCommands
+}
+
 func (p program) resolveFill() program {
 	var newCommands []command
 	for _, c := range p {
@@ -550,7 +926,7 @@ func (p program) resolveFill() program {
 		}
 
 		duration := parseCount(c.fields[1], c.lineNo)
-		newCommands = append(newCommands, fillCommands(subCommands, duration)...)
+		newCommands = append(newCommands, fillCommands(subCommands, duration, c)...)
 	}
 	return newCommands
 }
@@ -579,7 +955,9 @@ type XMLLabel struct {
 
 // XMLProject must be exported to work with encoding/xml.
 type XMLProject struct {
-	Labels []XMLLabel `xml:"labeltrack>label"`
+	Name   string         `xml:"projname,attr"`
+	Tracks []XMLWaveTrack `xml:"wavetrack"`
+	Labels []XMLLabel     `xml:"labeltrack>label"`
 }
 
 func readLabels(reader io.Reader) ([]label, error) {
@@ -590,25 +968,21 @@ func readLabels(reader io.Reader) ([]label, error) {
 
 	var labels []label
 	for _, l := range project.Labels {
-		fields := strings.Split(l.Title, ":")
-		for i, f := range fields {
-			fields[i] = strings.TrimSpace(f)
-		}
-
-		labels = append(labels, label{name: l.Title, fields: fields, start: int(l.Start * 100), end: int(l.End * 100)})
+		labels = append(labels, label{name: l.Title, start: int(l.Start * 100), end: int(l.End * 100)})
 	}
 	return labels, nil
 }
 
-func mapFromLabels(labels []label) map[string]label {
-	labelsMap := make(map[string]label)
+// mapFromLabels maps the lowercased names of labels to all labels with
+// that name, sorted by start.
+func mapFromLabels(labels []label) map[string][]label {
+	labelsMap := make(map[string][]label)
 	for _, l := range labels {
-		_, ok := labelsMap[l.name]
-		if ok {
-			fmt.Fprintf(os.Stderr, "Error: Label %s defined more than once\n", l.name)
-			os.Exit(1)
-		}
-		labelsMap[l.name] = l
+		name := strings.ToLower(l.name)
+		labelsMap[name] = append(labelsMap[name], l)
+	}
+	for _, ls := range labelsMap {
+		sort.Stable(timeline(ls))
 	}
 	return labelsMap
 }
@@ -629,94 +1003,258 @@ func (ls timeline) Swap(i, j int) {
 	ls[j] = tmp
 }
 
-func (l label) clubs() ([]string, []string) {
-	fields := l.fields
-	matches, err := regexp.MatchString("^[cC]\\s*\\d+(,\\d+)*$", fields[0])
-	if err != nil {
-		panic("Messed up regular expression")
+func (l label) spec() labelSpec {
+	if l.timelineName != "" {
+		return parseLabelTitle(l.timelineName)
+	}
+	return parseLabelTitle(l.name)
+}
+
+type rampStop struct {
+	color  string
+	hold   bool
+	anchor int
+	time   int
+}
+
+var rampAnchorRegexp = regexp.MustCompile("^(.*?)\\s*@\\s*(\\d+)\\s*(%?)$")
+
+func parseRampStop(colors map[string]color, field string, hold bool, duration int, labelName string) rampStop {
+	stop := rampStop{color: field, hold: hold, anchor: -1}
+	matches := rampAnchorRegexp.FindStringSubmatch(field)
+	if matches != nil {
+		stop.color = matches[1]
+		stop.anchor = parseNumber(matches[2], -1)
+		if matches[3] == "%" {
+			if stop.anchor > 100 {
+				errorExit(-1, "Ramp position `%s` beyond the end of label `%s`", field, labelName)
+			}
+			stop.anchor = stop.anchor * duration / 100
+		}
+		if stop.anchor > duration {
+			errorExit(-1, "Ramp position `%s` beyond the end of label `%s`", field, labelName)
+		}
 	}
-	var clubs []string
-	if matches {
-		clubs = strings.Split(fields[0][1:len(fields[0])], ",")
-		fields = fields[1:len(fields)]
+
+	ok, _, _ := lookupColor(colors, stop.color)
+	if !ok {
+		errorExit(-1, "Unknown color `%s`", stop.color)
 	}
-	return clubs, fields
+	return stop
 }
 
-func (ls timeline) program(colors map[string]color, subs map[string]sub) program {
-	var commands []command
-	for name, c := range colors {
-		commands = append(commands, command{fields: append([]string{"COLOR", name}, c.fields()...)})
+// rampCommands produces the commands for a `RAMP:C1:C2:...:Cn` label.
+// Colors can be followed by `@N%` or `@N` to fix the time at which
+// the ramp arrives at them, as a percentage of the label's duration or
+// absolutely.  `HOLD:C` stays on color `C` instead of ramping to it.
+// Segments without a fixed time share the time between their
+// neighbors evenly.
+func rampCommands(colors map[string]color, fields []string, duration int, labelName string) []command {
+	var stops []rampStop
+	for i := 0; i < len(fields); i++ {
+		hold := strings.ToLower(fields[i]) == "hold"
+		if hold {
+			i++
+			if i == len(fields) {
+				errorExit(-1, "HOLD without color in label `%s`", labelName)
+			}
+		}
+		stops = append(stops, parseRampStop(colors, fields[i], hold, duration, labelName))
 	}
-	commands = append(commands, command{fields: []string{"C", "0", "0", "0"}})
-	for _, l := range ls {
-		duration := l.end - l.start
 
-		var labelCommands []command
+	if len(stops) < 2 {
+		errorExit(-1, "Ramp in label `%s` needs at least two colors", labelName)
+	}
+	if stops[0].hold || stops[0].anchor >= 0 {
+		errorExit(-1, "Ramp in label `%s` must start with a plain color", labelName)
+	}
 
-		labelCommands = append(labelCommands, command{fields: []string{"TIME", strconv.FormatInt(int64(l.start), 10)}})
+	stops[0].anchor = 0
+	last := len(stops) - 1
+	if stops[last].anchor < 0 {
+		stops[last].anchor = duration
+	}
 
-		clubs, fields := l.clubs()
+	previous := 0
+	for i := 1; i < len(stops); i++ {
+		if stops[i].anchor < 0 {
+			continue
+		}
+		if stops[i].anchor < stops[previous].anchor {
+			errorExit(-1, "Ramp positions in label `%s` are not in order", labelName)
+		}
+		start := stops[previous].anchor
+		span := stops[i].anchor - start
+		for j := previous + 1; j <= i; j++ {
+			stops[j].time = start + (j-previous)*span/(i-previous)
+		}
+		previous = i
+	}
 
-		if len(fields) == 1 {
-			name := strings.ToLower(fields[0])
+	commands := []command{{lineNo: noLine, fields: []string{"C", stops[0].color}}}
+	for i := 1; i < len(stops); i++ {
+		stop := stops[i]
+		time := stop.time - stops[i-1].time
+		if stop.hold {
+			commands = append(commands, command{lineNo: noLine, fields: []string{"C", stop.color}})
+			if time > 0 {
+				commands = append(commands, command{lineNo: noLine, fields: []string{"D", strconv.FormatInt(int64(time), 10)}})
+			}
+		} else if time > 0 {
+			commands = append(commands, command{lineNo: noLine, fields: []string{"RAMP", stop.color, strconv.FormatInt(int64(time), 10)}})
+		} else {
+			commands = append(commands, command{lineNo: noLine, fields: []string{"C", stop.color}})
+		}
+	}
 
-			ok, _, _ := lookupColor(colors, name)
-			if ok {
-				colorCommand := command{fields: []string{"C", name}}
-				labelCommands = append(labelCommands, colorCommand)
-			} else {
-				sub, ok := subs[name]
-				if !ok {
-					errorExit(-1, "`%s` is not a color or a sub", name)
-				}
+	return commands
+}
 
-				definitions := map[string]int{"duration": duration}
-				subCommands := program(sub.commands).resolveExprs(make(map[string]label), definitions)
+func lookupColors(colors map[string]color, descriptions []string) {
+	for _, c := range descriptions {
+		ok, _, _ := lookupColor(colors, c)
+		if !ok {
+			errorExit(-1, "Unknown color `%s`", c)
+		}
+	}
+}
 
-				fillCommand := command{
-					fields:      []string{"FILL", strconv.FormatInt(int64(duration), 10)},
-					endLine:     "E",
-					subCommands: subCommands}
+func labelElementCommands(e labelElement, colors map[string]color, subs map[string]sub, definitions map[string]int, duration int, labelName string) []command {
+	switch e.kind {
+	case "ramp":
+		return rampCommands(colors, e.args, duration, labelName)
+	case "fadein":
+		lookupColors(colors, e.args)
+		return []command{
+			{lineNo: noLine, fields: []string{"C", "0", "0", "0"}},
+			{lineNo: noLine, fields: []string{"RAMP", e.args[0], strconv.FormatInt(int64(duration), 10)}}}
+	case "fadeout":
+		return []command{{lineNo: noLine, fields: []string{"RAMP", "0", "0", "0", strconv.FormatInt(int64(duration), 10)}}}
+	case "strobe":
+		if len(e.args) > 3 {
+			errorExit(-1, "Too many arguments to strobe in label `%s`", labelName)
+		}
+		lookupColors(colors, e.args[0:1])
+		period := 10
+		on := 2
+		if len(e.args) > 1 {
+			period = parseCount(e.args[1], -1)
+		}
+		if len(e.args) > 2 {
+			on = parseCount(e.args[2], -1)
+		}
+		if on >= period {
+			errorExit(-1, "Strobe in label `%s` must be on for less than its period", labelName)
+		}
+		loopCommand := command{
+			lineNo:  noLine,
+			fields:  []string{"L", strconv.FormatInt(int64(duration/period+1), 10)},
+			endLine: "E",
+			subCommands: []command{
+				{lineNo: noLine, fields: []string{"C", e.args[0]}},
+				{lineNo: noLine, fields: []string{"D", strconv.FormatInt(int64(on), 10)}},
+				{lineNo: noLine, fields: []string{"C", "0", "0", "0"}},
+				{lineNo: noLine, fields: []string{"D", strconv.FormatInt(int64(period-on), 10)}}}}
+		return []command{{
+			lineNo:      noLine,
+			fields:      []string{"FILL", strconv.FormatInt(int64(duration), 10)},
+			endLine:     "E",
+			subCommands: []command{loopCommand}}}
+	case "name":
+	default:
+		errorExit(-1, "Unknown effect `%s` in label `%s`", e.kind, labelName)
+	}
 
-				labelCommands = append(labelCommands, fillCommand)
-			}
-		} else if len(fields) > 2 && strings.ToLower(fields[0]) == "ramp" {
-			colorFields := fields[1:len(fields)]
-			for _, c := range colorFields {
-				ok, _, _ := lookupColor(colors, c)
-				if !ok {
-					errorExit(-1, "Unknown color `%s`", c)
-				}
+	if len(e.args) > 1 || e.count > 1 {
+		lookupColors(colors, e.args)
+
+		var commands []command
+		slots := len(e.args) * e.count
+		timeSoFar := 0
+		for i := 0; i < slots; i++ {
+			time := (i+1)*duration/slots - timeSoFar
+			commands = append(commands, command{lineNo: noLine, fields: []string{"C", e.args[i%len(e.args)]}})
+			if time > 0 {
+				commands = append(commands, command{lineNo: noLine, fields: []string{"D", strconv.FormatInt(int64(time), 10)}})
 			}
+			timeSoFar += time
+		}
+		return commands
+	}
+
+	name := strings.ToLower(e.args[0])
 
-			colorCommand := command{fields: []string{"C", colorFields[0]}}
-			labelCommands = append(labelCommands, colorCommand)
+	ok, _, _ := lookupColor(colors, name)
+	if ok {
+		return []command{{lineNo: noLine, fields: []string{"C", name}}}
+	}
 
-			rampFields := colorFields[1:len(colorFields)]
-			timeSoFar := 0
-			for i, c := range rampFields {
-				timeTarget := (i + 1) * duration / len(rampFields)
-				time := timeTarget - timeSoFar
+	sub, ok := subs[name]
+	if !ok {
+		errorExit(-1, "`%s` is not a color or a sub", name)
+	}
 
-				rampCommand := command{fields: []string{"RAMP", c, strconv.FormatInt(int64(time), 10)}}
-				labelCommands = append(labelCommands, rampCommand)
+	subDefinitions := map[string]int{"duration": duration}
+	for name, v := range definitions {
+		subDefinitions[name] = v
+	}
+	subCommands := program(sub.commands).resolveExprs(make(map[string][]label), subDefinitions)
 
-				timeSoFar += time
-			}
+	return []command{{
+		lineNo:      noLine,
+		fields:      []string{"FILL", strconv.FormatInt(int64(duration), 10)},
+		endLine:     "E",
+		subCommands: subCommands}}
+}
 
-			if timeSoFar != duration {
-				panic("I can't do math")
+func (ls timeline) program(colors map[string]color, subs map[string]sub, definitions map[string]int) program {
+	var commands []command
+	for name, c := range colors {
+		commands = append(commands, command{lineNo: noLine, fields: append([]string{"COLOR", name}, c.fields()...)})
+	}
+	commands = append(commands, command{lineNo: noLine, fields: []string{"C", "0", "0", "0"}})
+	for _, l := range ls {
+		duration := l.end - l.start
+
+		var labelCommands []command
+
+		labelCommands = append(labelCommands, command{lineNo: noLine, fields: []string{"TIME", strconv.FormatInt(int64(l.start), 10)}})
+
+		spec := l.spec()
+		clubs := spec.clubs
+
+		// A point label that isn't followed by another one switches
+		// to its color for good.
+		held := duration == 0
+		if held && !spec.isSingleColor(colors) {
+			errorExit(-1, "Point label `%s` must be a color or be followed by another point label", l.name)
+		}
+		if !held && duration < len(spec.elements) {
+			errorExit(-1, "Label `%s` is too short for a sequence of %d", l.name, len(spec.elements))
+		}
+
+		timeSoFar := 0
+		for i, e := range spec.elements {
+			timeTarget := (i + 1) * duration / len(spec.elements)
+			time := timeTarget - timeSoFar
+
+			labelCommands = append(labelCommands, labelElementCommands(e, colors, subs, definitions, time, l.name)...)
+			if i < len(spec.elements)-1 {
+				labelCommands = append(labelCommands, command{lineNo: noLine, fields: []string{"TIME", strconv.FormatInt(int64(l.start+timeTarget), 10)}})
 			}
-		} else {
-			errorExit(-1, "Incorrect label `%s`", l.name)
+
+			timeSoFar += time
+		}
+
+		if !held {
+			labelCommands = append(labelCommands, command{lineNo: noLine, fields: []string{"TIME", strconv.FormatInt(int64(l.end), 10)}})
+			labelCommands = append(labelCommands, command{lineNo: noLine, fields: []string{"C", "0", "0", "0"}})
 		}
 
-		labelCommands = append(labelCommands, command{fields: []string{"TIME", strconv.FormatInt(int64(l.end), 10)}})
-		labelCommands = append(labelCommands, command{fields: []string{"C", "0", "0", "0"}})
+		setLabel(labelCommands, l.name)
 
 		if len(clubs) > 0 {
-			clubCommand := command{fields: append([]string{"CLUBS"}, clubs...), endLine: "E"}
+			clubCommand := command{lineNo: noLine, label: l.name, fields: append([]string{"CLUBS"}, clubs...), endLine: "E"}
 			clubCommand.subCommands = labelCommands
 
 			labelCommands = []command{clubCommand}
@@ -725,58 +1263,79 @@ func (ls timeline) program(colors map[string]color, subs map[string]sub) program
 		commands = append(commands, labelCommands...)
 	}
 
-	commands = append(commands, command{fields: []string{"END"}})
+	commands = append(commands, command{lineNo: noLine, fields: []string{"END"}})
 	return commands
 }
 
-func (ls timeline) checkConsistency() {
-	allActive := 0
-	var clubsActive []int
-
-	for _, l := range ls {
-		clubs, _ := l.clubs()
-		var clubsString string
-		if len(clubs) == 0 {
-			clubsString = "all clubs"
-		} else {
-			clubsString = "clubs " + strings.Join(clubs, ", ")
+// extendMarkers makes each point label last until the next label for
+// the same clubs starts, whether that's another point label or not.
+func (ls timeline) extendMarkers() {
+	for i := range ls {
+		if ls[i].start != ls[i].end {
+			continue
 		}
-
-		if l.start < allActive {
-			errorExit(-1, "Label collision for %s at time %d", clubsString, l.start)
+		clubs := ls[i].spec().clubsKey()
+		for j := i + 1; j < len(ls); j++ {
+			if ls[j].start > ls[i].start && ls[j].spec().clubsKey() == clubs {
+				ls[i].end = ls[j].start
+				break
+			}
 		}
+	}
+}
 
-		if len(clubs) == 0 {
-			for i, active := range clubsActive {
-				if l.start < active {
-					errorExit(-1, "Label collision for club %d at time %d", i, l.start)
-				}
-			}
-			allActive = l.end
+func (ls timeline) checkConsistency(groups map[string]clubSelector) {
+	selectors := make([]clubSelector, len(ls))
+	highest := 1
+	for i, l := range ls {
+		clubs := l.spec().clubs
+		selectors[i] = allClubs
+		if len(clubs) > 0 {
+			selectors[i] = parseClubSelectors(clubs, groups, -1)
 		}
-		for _, c := range clubs {
-			i := parseNumber(c, -1)
-			for i >= len(clubsActive) {
-				clubsActive = append(clubsActive, 0)
-			}
+		highest = maxInt(highest, selectors[i].highest)
+	}
 
-			if l.start < clubsActive[i] {
-				errorExit(-1, "Label collision for club %d at time %d", i, l.start)
+	// Clubs beyond the highest one mentioned are all treated alike,
+	// except for odd and even.
+	for club := 1; club <= highest+2; club++ {
+		active := 0
+		for i, l := range ls {
+			if !selectors[i].matches(club) {
+				continue
 			}
-
-			clubsActive[i] = l.end
+			if l.start < active {
+				errorExit(-1, "Label collision for club %d at time %d", club, l.start)
+			}
+			active = l.end
 		}
 	}
 }
 
 func main() {
-	var err error
-
 	audacityFlag := flag.String("audacity", "", "Audacity file path")
+	audioFlag := flag.String("audio", "", "WAV file to use instead of the Audacity project's audio")
+	beatsFlag := flag.Bool("beats", false, "Detect beats in the audio and add labels for them")
+	downbeatsFlag := flag.Int("downbeats", 0, "Number of beats per bar for downbeat labels")
 	clubFlag := flag.Int("club", 0, "Club to specialize for")
+	clubsFlag := flag.Int("clubs", 0, "Total number of clubs")
 	inputFlag := flag.String("input", "-", "Input file")
-	outputFlag := flag.String("output", "-", "Output file")
+	outputFlag := flag.String("output", "-", "Output file, where %d stands for the club when compiling for all clubs")
 	timelineFlag := flag.Bool("timeline", false, "Produce program from timeline")
+	maxCommandsFlag := flag.Int("max-commands", 0, "Maximum number of commands the clubs can store, or 0 not to check")
+	maxDepthFlag := flag.Int("max-depth", 0, "Maximum nesting depth of loops, or 0 not to check")
+	maxLoopCountFlag := flag.Int("max-loop-count", 0, "Maximum number of iterations of a loop, or 0 not to check")
+	sizeWarnFlag := flag.Bool("size-warn", false, "Only warn if the program exceeds size limits")
+	noOptimizeFlag := flag.Bool("O0", false, "Don't optimize the program")
+	timePolicyFlag := flag.String("time-policy", "error", "What to do with a TIME before the current time: error, clip or skip")
+	watchFlag := flag.Bool("watch", false, "Recompile whenever the input files change")
+	formatFlag := flag.String("format", "glo", "Output format: glo or json")
+	annotateFlag := flag.String("annotate", "top", "Which commands to annotate with the time: none, top or all")
+	timeFormatFlag := flag.String("time-format", "cs", "Format of times in annotations: cs for hundredths of a second, or mmss")
+	annotateColorFlag := flag.Bool("annotate-color", false, "Show the club's color in annotations")
+	stripCommentsFlag := flag.Bool("strip-comments", false, "Leave out comments, empty lines, indentation and annotations")
+	prettyFlag := flag.Bool("pretty", false, "Indent commands by nesting and keep their comments")
+	sourceMapFlag := flag.String("source-map", "", "File to write a map from output lines to input lines and labels to")
 
 	flag.Parse()
 
@@ -784,64 +1343,88 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error: Club can't be negative\n")
 		os.Exit(1)
 	}
+	if *clubsFlag < 0 || (*clubsFlag > 0 && *clubFlag > *clubsFlag) {
+		fmt.Fprintf(os.Stderr, "Error: Club must be between 1 and the number of clubs\n")
+		os.Exit(1)
+	}
 
-	var labels []label
-	if *audacityFlag != "" {
-		file, err := os.Open(*audacityFlag)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Can't open audacity file `%s`: %s\n", *audacityFlag, err.Error())
-			os.Exit(1)
-		}
-		defer file.Close()
+	policy, ok := timePolicies[*timePolicyFlag]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: Unknown time policy `%s`\n", *timePolicyFlag)
+		os.Exit(1)
+	}
 
-		labels, err = readLabels(file)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading Audacity file `%s`: %s\n", *audacityFlag, err.Error())
-			os.Exit(1)
-		}
+	if !outputFormats[*formatFlag] {
+		fmt.Fprintf(os.Stderr, "Error: Unknown output format `%s`\n", *formatFlag)
+		os.Exit(1)
 	}
 
-	inFile := os.Stdin
-	if *inputFlag != "-" {
-		inFile, err = os.Open(*inputFlag)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening input file `%s`: %s\n", *inputFlag, err.Error())
-			os.Exit(1)
-		}
-		defer inFile.Close()
+	annotationMode, ok := annotations[*annotateFlag]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: Unknown annotation `%s`\n", *annotateFlag)
+		os.Exit(1)
+	}
+	if !timeFormats[*timeFormatFlag] {
+		fmt.Fprintf(os.Stderr, "Error: Unknown time format `%s`\n", *timeFormatFlag)
+		os.Exit(1)
 	}
-	inputProgram := parseProgram(inFile)
 
-	var labelsMap map[string]label
+	printing := printOptions{layout: layoutVerbatim, mode: annotationMode, timeFormat: *timeFormatFlag, color: *annotateColorFlag}
+	if *stripCommentsFlag && *prettyFlag {
+		fmt.Fprintf(os.Stderr, "Error: Can't strip comments and keep them at the same time\n")
+		os.Exit(1)
+	}
+	if *stripCommentsFlag {
+		printing.layout = layoutStripped
+		printing.mode = annotateNone
+	}
+	if *prettyFlag {
+		printing.layout = layoutPretty
+	}
 
-	if *timelineFlag {
-		sort.Sort(timeline(labels))
-		timeline(labels).checkConsistency()
-		colors := inputProgram.gatherColors()
-		subs := inputProgram.gatherSubs()
-		inputProgram = timeline(labels).program(colors, subs)
-	} else {
-		labelsMap = mapFromLabels(labels)
+	if *sourceMapFlag != "" && *formatFlag != "glo" {
+		fmt.Fprintf(os.Stderr, "Error: Source maps only work with glo output\n")
+		os.Exit(1)
 	}
 
-	specialized := inputProgram
-	if *clubFlag != 0 {
-		specialized = inputProgram.specializeForClub(*clubFlag)
+	opts := options{
+		audacity:   *audacityFlag,
+		audio:      *audioFlag,
+		input:      *inputFlag,
+		output:     *outputFlag,
+		beats:      *beatsFlag,
+		downbeats:  *downbeatsFlag,
+		club:       *clubFlag,
+		clubs:      *clubsFlag,
+		timeline:   *timelineFlag,
+		limits:     sizeLimits{commands: *maxCommandsFlag, depth: *maxDepthFlag, loopCount: *maxLoopCountFlag},
+		sizeWarn:   *sizeWarnFlag,
+		optimize:   !*noOptimizeFlag,
+		timePolicy: policy,
+		format:     *formatFlag,
+		sourceMap:  *sourceMapFlag,
+		printing:   printing,
 	}
-	colored := specialized.resolveColor()
-	delabeled := colored.resolveExprs(labelsMap, make(map[string]int))
-	filled := delabeled.resolveFill()
-	finalProgram := filled.resolveTime()
 
-	outFile := os.Stdout
-	if *outputFlag != "-" {
-		outFile, err = os.Create(*outputFlag)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening output file `%s`: %s\n", *outputFlag, err.Error())
+	if len(opts.compiledClubs()) > 1 && opts.sourceMap != "" && !strings.Contains(opts.sourceMap, "%d") {
+		fmt.Fprintf(os.Stderr, "Error: The source map path needs a %%d when compiling for all clubs\n")
+		os.Exit(1)
+	}
+
+	if *watchFlag {
+		if opts.input == "-" {
+			fmt.Fprintf(os.Stderr, "Error: Watching needs an input file\n")
 			os.Exit(1)
 		}
-		defer outFile.Close()
+		watch(opts)
 	}
 
-	finalProgram.annotateTimes(outFile)
+	programs, err := compileAll(opts)
+	if err == nil {
+		err = writePrograms(opts, programs)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// compileSource compiles a program with labels but without audio for
+// one club, or for no club in particular if club is zero.
+func compileSource(source string, labels []label, opts options, club int) (p program, err error) {
+	err = catchError(func() {
+		proj := project{input: parseProgram(strings.NewReader(source)), labels: labels}
+		p = proj.compile(opts, club)
+	})
+	return p, err
+}
+
+// catchError runs f and returns the compile error it stops with, if
+// any.
+func catchError(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(compileError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	f()
+	return nil
+}
+
+// programLines returns the commands of a program as they're printed,
+// without comments, empty lines or indentation.
+func programLines(p program) []string {
+	var b strings.Builder
+	p.annotateTimes(&b, printOptions{layout: layoutStripped, mode: annotateNone})
+	return strings.Fields(b.String())
+}
+
+func TestResolveTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		policy timePolicy
+		club   int
+		want   string
+	}{
+		{
+			name:   "time",
+			source: "C,255,0,0\nD,10\nTIME,50\nC,0,0,0\n",
+			want:   "C,255,0,0 D,50 C,0,0,0",
+		},
+		{
+			name:   "clip after fill",
+			source: "FILL,100\n\tC,255,0,0\nE\nTIME,50\nC,0,0,0\n",
+			policy: timePolicyClip,
+			want:   "C,255,0,0 D,50 C,0,0,0",
+		},
+		{
+			name:   "clip within fill",
+			source: "FILL,100\n\tC,255,0,0\n\tD,80\n\tTIME,60\n\tC,0,0,255\nE\n",
+			policy: timePolicyClip,
+			want:   "C,255,0,0 D,60 C,0,0,255 D,40",
+		},
+		{
+			name:   "clip loop",
+			source: "L,5\n\tC,255,0,0\n\tD,10\n\tC,0,0,0\n\tD,10\nE\nTIME,55\nC,0,0,255\n",
+			policy: timePolicyClip,
+			want:   "L,2 C,255,0,0 D,10 C,0,0,0 D,10 E C,255,0,0 D,10 C,0,0,0 D,5 C,0,0,255",
+		},
+		{
+			name:   "clip past clubs without club",
+			source: "D,50\nCLUBS,1\n\tC,255,0,0\n\tD,80\nE\nTIME,30\n",
+			policy: timePolicyClip,
+			want:   "D,30 CLUBS,1 C,255,0,0 D,80 E",
+		},
+		{
+			name:   "clip within clubs without club",
+			source: "D,50\nCLUBS,1\n\tC,255,0,0\n\tD,80\n\tTIME,60\n\tC,0,0,0\nE\n",
+			policy: timePolicyClip,
+			want:   "D,50 CLUBS,1 C,255,0,0 D,10 C,0,0,0 E",
+		},
+		{
+			name:   "clip clubs for club",
+			source: "D,50\nCLUBS,1\n\tC,255,0,0\n\tD,80\nE\nTIME,90\nC,0,0,0\n",
+			policy: timePolicyClip,
+			club:   1,
+			want:   "D,50 C,255,0,0 D,40 C,0,0,0",
+		},
+		{
+			name:   "skip",
+			source: "D,100\nTIME,50\nC,0,0,0\n",
+			policy: timePolicySkip,
+			want:   "D,100 C,0,0,0",
+		},
+		{
+			name:   "clubs without club",
+			source: "CLUBS,1\n\tTIME,100\n\tC,255,0,0\nE\nCLUBS,2\n\tTIME,150\n\tC,0,255,0\nE\nTIME,200\n",
+			want:   "CLUBS,1 D,100 C,255,0,0 E CLUBS,2 D,150 C,0,255,0 E D,200",
+		},
+		{
+			name:   "fill with clubs without club",
+			source: "FILL,100\n\tCLUBS,1\n\t\tC,255,0,0\n\t\tD,30\n\tE\nE\nTIME,150\n",
+			want:   "CLUBS,1 C,255,0,0 D,30 E D,120",
+		},
+		{
+			name:   "clubs for club",
+			source: "CLUBS,1\n\tTIME,100\n\tC,255,0,0\nE\nCLUBS,2\n\tTIME,150\n\tC,0,255,0\nE\nTIME,200\n",
+			club:   2,
+			want:   "D,150 C,0,255,0 D,50",
+		},
+	}
+
+	for _, test := range tests {
+		p, err := compileSource(test.source, nil, options{timePolicy: test.policy, optimize: true}, test.club)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		got := strings.Join(programLines(p), " ")
+		if got != test.want {
+			t.Errorf("%s: got `%s`, want `%s`", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSharedDuration(t *testing.T) {
+	tests := []struct {
+		source string
+		own    int
+		shared int
+	}{
+		{"D,10\nRAMP,1,2,3,5\n", 15, 15},
+		{"CLUBS,1\n\tD,10\nE\nD,5\n", 15, 5},
+		{"L,3\n\tD,2\n\tCLUBS,2\n\t\tD,10\n\tE\nE\n", 36, 6},
+		{"FILL,20\n\tCLUBS,1\n\t\tD,50\n\tE\nE\n", 20, 20},
+		{"CLUBS,1\n\tL,4\n\t\tD,5\n\tE\nE\n", 20, 0},
+	}
+
+	for _, test := range tests {
+		cs := parseProgram(strings.NewReader(test.source))
+		if own := commandsDuration(cs); own != test.own {
+			t.Errorf("%q: duration %d, want %d", test.source, own, test.own)
+		}
+		if shared := commandsSharedDuration(cs); shared != test.shared {
+			t.Errorf("%q: shared duration %d, want %d", test.source, shared, test.shared)
+		}
+	}
+}
+
+func TestResolveTimeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		policy timePolicy
+		want   string
+	}{
+		{"back in time", "D,100\nTIME,50\n", timePolicyError, "Cannot go back in time"},
+		{"loop", "L,2\n\tTIME,50\nE\n", timePolicyError, "TIME not supported in loops"},
+		{"clip before block", "D,10\nFILL,100\n\tD,50\n\tTIME,5\nE\n", timePolicyClip, "before the start of the block at 10"},
+	}
+
+	for _, test := range tests {
+		_, err := compileSource(test.source, nil, options{timePolicy: test.policy, optimize: true}, 0)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want `%s`", test.name, err, test.want)
+		}
+	}
+}
+
+func TestClipCommands(t *testing.T) {
+	time := command{fields: []string{"TIME", "40"}, lineNo: 9}
+	tests := []struct {
+		source   string
+		duration int
+		want     string
+	}{
+		{"D,10\nRAMP,255,0,0,50\nC,0,0,0\n", 30, "D,10 RAMP,255,0,0,20 C,0,0,0"},
+		{"D,10\nD,10\nD,10\n", 15, "D,10 D,5"},
+		{"D,10\nD,10\n", 20, "D,10 D,10"},
+		{"L,5\n\tC,255,0,0\n\tD,4\n\tC,0,0,0\n\tD,6\nE\n", 27, "L,2 C,255,0,0 D,4 C,0,0,0 D,6 E C,255,0,0 D,4 C,0,0,0 D,3"},
+		{"L,5\n\tD,10\nE\n", 20, "L,2 D,10 E"},
+		{"FILL,50\n\tC,255,0,0\nE\nC,0,0,255\n", 12, "FILL,12 C,255,0,0 E C,0,0,255"},
+	}
+
+	for _, test := range tests {
+		cs := clipCommands(parseProgram(strings.NewReader(test.source)), test.duration, time)
+		if got := strings.Join(programLines(cs), " "); got != test.want {
+			t.Errorf("%q to %d: got `%s`, want `%s`", test.source, test.duration, got, test.want)
+		}
+	}
+}
+
+func TestRampLabels(t *testing.T) {
+	colors := "COLOR,black,0,0,0\nCOLOR,white,255,255,255\nCOLOR,red,255,0,0\n"
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"RAMP:black:white", "C,0,0,0 RAMP,255,255,255,100"},
+		{"RAMP:black:red@25%:white", "C,0,0,0 RAMP,255,0,0,25 RAMP,255,255,255,75"},
+		{"RAMP:black:HOLD:red:white", "C,0,0,0 C,255,0,0 D,50 RAMP,255,255,255,50"},
+		{"RAMP:black:HOLD:red@30:white", "C,0,0,0 C,255,0,0 D,30 RAMP,255,255,255,70"},
+	}
+
+	for _, test := range tests {
+		labels := []label{{name: test.name, start: 100, end: 200}}
+		p, err := compileSource(colors, labels, options{timeline: true}, 0)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		got := strings.Join(programLines(p), " ")
+		if !strings.Contains(got, "D,100 "+test.want+" C,0,0,0") {
+			t.Errorf("%s: got `%s`, want `%s`", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRampLabelErrors(t *testing.T) {
+	colors := "COLOR,black,0,0,0\nCOLOR,white,255,255,255\n"
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"RAMP", "needs at least two colors"},
+		{"RAMP:black", "needs at least two colors"},
+		{"RAMP:HOLD:black:white", "must start with a plain color"},
+		{"RAMP:black:HOLD", "HOLD without color"},
+	}
+
+	for _, test := range tests {
+		labels := []label{{name: test.name, start: 100, end: 200}}
+		_, err := compileSource(colors, labels, options{timeline: true}, 0)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want `%s`", test.name, err, test.want)
+		}
+	}
+}
+
+func TestRampCommands(t *testing.T) {
+	colors := map[string]color{"black": {0, 0, 0}, "red": {255, 0, 0}, "green": {0, 255, 0}, "blue": {0, 0, 255}}
+	tests := []struct {
+		stops    string
+		duration int
+		want     string
+	}{
+		{"black:red:green:blue", 100, "C,black RAMP,red,33 RAMP,green,33 RAMP,blue,34"},
+		{"black:red:green@60:blue", 100, "C,black RAMP,red,30 RAMP,green,30 RAMP,blue,40"},
+		{"black:red@33%:blue", 10, "C,black RAMP,red,3 RAMP,blue,7"},
+		{"black:red@0:blue", 50, "C,black C,red RAMP,blue,50"},
+		{"black:HOLD:red@20:HOLD:green:blue@100%", 80, "C,black C,red D,20 C,green D,30 RAMP,blue,30"},
+		{"black:red@50:green@50:blue", 60, "C,black RAMP,red,50 C,green RAMP,blue,10"},
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, c := range rampCommands(colors, strings.Split(test.stops, ":"), test.duration, "ramp") {
+			got = append(got, strings.Join(c.fields, ","))
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%s over %d: got `%s`, want `%s`", test.stops, test.duration, strings.Join(got, " "), test.want)
+		}
+	}
+
+	errors := []struct {
+		stops string
+		want  string
+	}{
+		{"black:red@60:green@40:blue", "not in order"},
+		{"black:red@101", "`red@101` beyond the end"},
+		{"black:red@101%", "`red@101%` beyond the end"},
+		{"black:purple", "Unknown color `purple`"},
+	}
+	for _, test := range errors {
+		err := catchError(func() { rampCommands(colors, strings.Split(test.stops, ":"), 100, "ramp") })
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want `%s`", test.stops, err, test.want)
+		}
+	}
+}
+
+func TestPointLabels(t *testing.T) {
+	colors := "COLOR,red,255,0,0\nCOLOR,blue,0,0,255\nCOLOR,white,255,255,255\n"
+	labels := []label{
+		{name: "red", start: 100, end: 100},
+		{name: "blue", start: 150, end: 150},
+		{name: "FADEOUT", start: 200, end: 250},
+		{name: "white", start: 300, end: 300},
+	}
+	p, err := compileSource(colors, labels, options{timeline: true}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := strings.Join(programLines(p), " ")
+	want := "C,0,0,0 D,100 C,255,0,0 D,50 C,0,0,0 C,0,0,255 D,50 C,0,0,0 RAMP,0,0,0,50 C,0,0,0 D,50 C,255,255,255 END"
+	if got != want {
+		t.Errorf("got  `%s`\nwant `%s`", got, want)
+	}
+
+	labels = []label{{name: "red/blue", start: 100, end: 100}}
+	_, err = compileSource(colors, labels, options{timeline: true}, 0)
+	if err == nil || !strings.Contains(err.Error(), "Point label `red/blue` must be a color") {
+		t.Errorf("last point label with two colors: got error %v", err)
+	}
+}
+
+func TestShortSequenceLabel(t *testing.T) {
+	colors := "COLOR,red,255,0,0\nCOLOR,white,255,255,255\n"
+	name := "FADEIN:red > strobe(white) > FADEOUT"
+
+	_, err := compileSource(colors, []label{{name: name, start: 100, end: 102}}, options{timeline: true}, 0)
+	if err == nil || !strings.Contains(err.Error(), "`"+name+"` is too short") {
+		t.Errorf("duration 2: got error %v, want one naming the label", err)
+	}
+
+	p, err := compileSource(colors, []label{{name: name, start: 100, end: 103}}, options{timeline: true}, 0)
+	if err != nil {
+		t.Fatalf("duration 3: %s", err.Error())
+	}
+	if duration := commandsDuration(p); duration != 103 {
+		t.Errorf("duration 3: program takes %d, want 103", duration)
+	}
+}
+
+func TestSpecializeWithoutClub(t *testing.T) {
+	source := "GROUP,left,1 3\nCLUBS,left\n\tC,255,0,0\nE\nCLUBS,2,4\n\tC,0,0,255\nE\nCLUBS,odd except 1\n\tC,0,255,0\nE\nD,10\n"
+	p, err := compileSource(source, nil, options{clubs: 5}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := strings.Join(programLines(p), " ")
+	want := "CLUBS,1,3 C,255,0,0 E CLUBS,2,4 C,0,0,255 E CLUBS,3,5 C,0,255,0 E D,10"
+	if got != want {
+		t.Errorf("got `%s`, want `%s`", got, want)
+	}
+
+	for _, source := range []string{"CHASE,1-3,255 255 255,10,60\n", "WAVE,1-3,255 255 255,10,60\n"} {
+		_, err := compileSource(source, nil, options{clubs: 3}, 0)
+		if err == nil || !strings.Contains(err.Error(), "-club") {
+			t.Errorf("%s: got error %v, want one asking for `-club`", strings.TrimSpace(source), err)
+		}
+	}
+}
+
+func TestOtherClubsBlocksAreNotEvaluated(t *testing.T) {
+	source := "CLUBS,1\n\tD,10\nE\nCLUBS,2 3\n\tD,60/(club-1)\n\tEACH,solo*\n\t\tC,255,0,0\n\tE\nE\n"
+	labels := []label{{name: "solo", start: 100, end: 200}}
+	want := map[int]string{1: "D,10", 2: "D,60 D,40 C,255,0,0", 3: "D,30 D,70 C,255,0,0"}
+	for club := 1; club <= 3; club++ {
+		ls := labels
+		if club == 1 {
+			ls = nil
+		}
+		p, err := compileSource(source, ls, options{clubs: 3}, club)
+		if err != nil {
+			t.Errorf("club %d: %s", club, err.Error())
+			continue
+		}
+		if got := strings.Join(programLines(p), " "); got != want[club] {
+			t.Errorf("club %d: got `%s`, want `%s`", club, got, want[club])
+		}
+	}
+}
+
+func TestGradientErrors(t *testing.T) {
+	colors := map[string]color{"red": {255, 0, 0}, "green": {0, 255, 0}}
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"GRADIENT,red,green,100,-3", "negative number of steps"},
+		{"GRADIENT,red,green,-100,3", "negative duration"},
+		{"GRADIENT,red,green,100,0", "Count can't be zero"},
+		{"GRADIENT,red,green,10,20", "more steps than its duration"},
+		{"GRADIENT,red,green,100,5,cmyk", "Unknown color space `cmyk`"},
+		{"GRADIENT,red,green,100", "GRADIENT needs two colors"},
+	}
+
+	for _, test := range tests {
+		c := command{fields: strings.Split(test.line, ","), lineNo: 4}
+		err := catchError(func() { gradientCommands(c, colors) })
+		if err == nil || !strings.Contains(err.Error(), test.want) || !strings.HasPrefix(err.Error(), "Error in line 5:") {
+			t.Errorf("%s: got error %v, want `%s` in line 5", test.line, err, test.want)
+		}
+	}
+}
+
+func TestResolvePick(t *testing.T) {
+	tests := []struct {
+		line  string
+		index int
+		want  string
+	}{
+		{"C,PICK,index,red,green,blue", 1, "C,red"},
+		{"C,PICK,index,red,green,blue", 3, "C,blue"},
+		{"C,PICK,index,red,green,blue", 4, "C,red"},
+		{"C,PICK,index,red,green,blue", 0, "C,blue"},
+		{"C,PICK,index,red,green,blue", -4, "C,green"},
+		{"RAMP,PICK,index*2,red,green,blue,50", 1, "RAMP,green,50"},
+		{"C,pick,index,white", 17, "C,white"},
+	}
+
+	for _, test := range tests {
+		c := command{fields: strings.Split(test.line, ","), lineNo: 3}
+		if !c.isPick() {
+			t.Errorf("%s isn't a PICK", test.line)
+			continue
+		}
+		got := c.resolvePick(nil, map[string]int{"index": test.index})
+		if got.line() != test.want {
+			t.Errorf("%s with index %d: got `%s`, want `%s`", test.line, test.index, got.line(), test.want)
+		}
+	}
+
+	for _, line := range []string{"C,PICK,1", "RAMP,PICK,1,10"} {
+		c := command{fields: strings.Split(line, ","), lineNo: 3}
+		err := catchError(func() { c.resolvePick(nil, nil) })
+		if err == nil || !strings.Contains(err.Error(), "PICK needs an index and at least one color") {
+			t.Errorf("%s: got error %v", line, err)
+		}
+	}
+}
+
+func TestClubDefinitions(t *testing.T) {
+	source := "COLOR,red,255,0,0\nCOLOR,green,0,255,0\nC,PICK,club,red,green\nD,(clubs-club+1)*10\n"
+	want := map[int]string{1: "C,255,0,0 D,30", 2: "C,0,255,0 D,20", 3: "C,255,0,0 D,10"}
+	for club := 1; club <= 3; club++ {
+		p, err := compileSource(source, nil, options{clubs: 3}, club)
+		if err != nil {
+			t.Errorf("club %d: %s", club, err.Error())
+			continue
+		}
+		if got := strings.Join(programLines(p), " "); got != want[club] {
+			t.Errorf("club %d: got `%s`, want `%s`", club, got, want[club])
+		}
+	}
+
+	if _, err := compileSource("D,club*10\n", nil, options{clubs: 3}, 0); err == nil || !strings.Contains(err.Error(), "`club` is only defined when given with `-club`") {
+		t.Errorf("without -club: got error %v", err)
+	}
+	if _, err := compileSource("D,clubs\n", nil, options{}, 2); err == nil || !strings.Contains(err.Error(), "`clubs` is only defined when given with `-clubs`") {
+		t.Errorf("without -clubs: got error %v", err)
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	labels := mapFromLabels([]label{
+		{name: "Eins", start: 300, end: 310},
+		{name: "zwei", start: 100, end: 110},
+		{name: "chorus", start: 500, end: 600},
+		{name: "chorus", start: 200, end: 250},
+		{name: "verse 1", start: 0, end: 90},
+		{name: "verse 2", start: 400, end: 490},
+	})
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"chorus", "chorus@200 chorus@500"},
+		{"CHORUS", "chorus@200 chorus@500"},
+		{"verse*", "verse 1@0 verse 2@400"},
+		{"verse ?", "verse 1@0 verse 2@400"},
+		{"/^(eins|zwei)$/", "zwei@100 Eins@300"},
+		{"/S/", "verse 1@0 chorus@200 Eins@300 verse 2@400 chorus@500"},
+		{"bridge", ""},
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, l := range matchLabels(labels, test.pattern, 0) {
+			got = append(got, fmt.Sprintf("%s@%d", l.name, l.start))
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%s: got `%s`, want `%s`", test.pattern, strings.Join(got, " "), test.want)
+		}
+	}
+}
+
+func TestResolveEach(t *testing.T) {
+	labels := mapFromLabels([]label{
+		{name: "chorus", start: 200, end: 250},
+		{name: "chorus", start: 500, end: 600},
+		{name: "hit", start: 520, end: 520},
+	})
+	source := "EACH,chorus\n\tC,PICK,index+1,red,blue\n\tD,duration/2\n\tAT,hit\n\t\tD,end-start+clubs\n\tE\nE\n"
+	p := parseProgram(strings.NewReader(source)).resolveEach(labels, map[string]int{"clubs": 4})
+
+	var got []string
+	for _, c := range p {
+		got = append(got, c.line())
+	}
+	want := "TIME,200 C,red D,25 TIME,520 D,4 TIME,500 C,blue D,50 TIME,520 D,4"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got  `%s`\nwant `%s`", strings.Join(got, " "), want)
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"EACH\nE\n", "EACH needs a label pattern"},
+		{"AT,a,b\nE\n", "AT needs a label pattern"},
+		{"EACH,verse*\nE\n", "No labels match `verse*`"},
+		{"EACH,/(/\nE\n", "Invalid regular expression `/(/`"},
+		{"EACH,[\nE\n", "Invalid pattern `[`"},
+	}
+	for _, test := range errors {
+		err := catchError(func() { parseProgram(strings.NewReader(test.source)).resolveEach(labels, nil) })
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %v, want `%s`", test.source, err, test.want)
+		}
+	}
+}
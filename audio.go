@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// audio holds the samples, between -1 and 1, for every channel.
+type audio struct {
+	rate     int
+	channels [][]float32
+}
+
+func (a audio) length() int {
+	if len(a.channels) == 0 {
+		return 0
+	}
+	return len(a.channels[0])
+}
+
+// rms is the root mean square of all channels between two times, in
+// hundredths of a second.
+func (a audio) rms(from int, to int) float64 {
+	first := from * a.rate / 100
+	last := to * a.rate / 100
+	if last > a.length() {
+		last = a.length()
+	}
+	if first >= last {
+		return 0
+	}
+
+	sum := 0.0
+	for _, channel := range a.channels {
+		for _, s := range channel[first:last] {
+			sum += float64(s) * float64(s)
+		}
+	}
+	return math.Sqrt(sum / float64((last-first)*len(a.channels)))
+}
+
+// mono mixes all channels down to one.
+func (a audio) mono() []float32 {
+	if len(a.channels) == 1 {
+		return a.channels[0]
+	}
+	samples := make([]float32, a.length())
+	for _, channel := range a.channels {
+		for i, s := range channel {
+			samples[i] += s / float32(len(a.channels))
+		}
+	}
+	return samples
+}
+
+// XMLBlockFile must be exported to work with encoding/xml.
+type XMLBlockFile struct {
+	Filename string `xml:"filename,attr"`
+	Len      int    `xml:"len,attr"`
+}
+
+// XMLWaveBlock must be exported to work with encoding/xml.
+type XMLWaveBlock struct {
+	Start      int           `xml:"start,attr"`
+	BlockFile  *XMLBlockFile `xml:"simpleblockfile"`
+	SilentFile *XMLBlockFile `xml:"silentblockfile"`
+	AliasFile  *XMLBlockFile `xml:"pcmaliasblockfile"`
+}
+
+// XMLWaveClip must be exported to work with encoding/xml.
+type XMLWaveClip struct {
+	Offset float64        `xml:"offset,attr"`
+	Blocks []XMLWaveBlock `xml:"sequence>waveblock"`
+}
+
+// XMLWaveTrack must be exported to work with encoding/xml.
+type XMLWaveTrack struct {
+	Name    string        `xml:"name,attr"`
+	Channel int           `xml:"channel,attr"`
+	Linked  int           `xml:"linked,attr"`
+	Mute    int           `xml:"mute,attr"`
+	Gain    *float64      `xml:"gain,attr"`
+	Rate    float64       `xml:"rate,attr"`
+	Clips   []XMLWaveClip `xml:"waveclip"`
+}
+
+// Audacity's values for the channel attribute of a track.
+const (
+	leftChannel  = 0
+	rightChannel = 1
+	monoChannel  = 2
+)
+
+// findBlockFiles maps the names of all the files in an Audacity
+// project's data directory to their paths.  Audacity spreads them over
+// subdirectories, which aren't given in the project file.
+func findBlockFiles(dataDir string) (map[string]string, error) {
+	paths := make(map[string]string)
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			paths[info.Name()] = path
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// readTrack puts together the samples of a track from its clips,
+// which start at their offsets, and their blocks, which start at their
+// positions within the clip.  Anything not covered by a block is
+// silence.
+func readTrack(track XMLWaveTrack, rate int, blockFiles map[string]string, dataDir string) ([]float32, error) {
+	var samples []float32
+	write := func(position int, data []float32) {
+		if position+len(data) > len(samples) {
+			samples = append(samples, make([]float32, position+len(data)-len(samples))...)
+		}
+		for i, s := range data {
+			samples[position+i] += s
+		}
+	}
+
+	for _, clip := range track.Clips {
+		clipStart := int(math.Floor(clip.Offset*float64(rate) + 0.5))
+		if clipStart < 0 {
+			return nil, fmt.Errorf("clip in track `%s` starts before the beginning", track.Name)
+		}
+		for _, block := range clip.Blocks {
+			position := clipStart + block.Start
+			switch {
+			case block.BlockFile != nil:
+				path, ok := blockFiles[block.BlockFile.Filename]
+				if !ok {
+					return nil, fmt.Errorf("block file `%s` not found in `%s`", block.BlockFile.Filename, dataDir)
+				}
+				data, blockRate, err := readAU(path)
+				if err != nil {
+					return nil, fmt.Errorf("reading block file `%s`: %s", path, err.Error())
+				}
+				if blockRate != rate {
+					return nil, fmt.Errorf("block file `%s` has rate %d instead of %d", path, blockRate, rate)
+				}
+				if len(data) < block.BlockFile.Len {
+					return nil, fmt.Errorf("block file `%s` is too short", path)
+				}
+				write(position, data[0:block.BlockFile.Len])
+			case block.SilentFile != nil:
+				write(position, make([]float32, block.SilentFile.Len))
+			case block.AliasFile != nil:
+				return nil, fmt.Errorf("track `%s` refers to external audio, which is not supported", track.Name)
+			}
+		}
+	}
+
+	gain := float32(1)
+	if track.Gain != nil {
+		gain = float32(*track.Gain)
+	}
+	for i := range samples {
+		samples[i] *= gain
+	}
+	return samples, nil
+}
+
+// readProjectAudio mixes the audio of all tracks in an Audacity
+// project that aren't muted.  If there are stereo tracks the result is
+// stereo, with mono tracks going to both channels.
+func readProjectAudio(aupPath string) (audio, error) {
+	file, err := os.Open(aupPath)
+	if err != nil {
+		return audio{}, err
+	}
+	defer file.Close()
+
+	var project XMLProject
+	if err := xml.NewDecoder(file).Decode(&project); err != nil {
+		return audio{}, err
+	}
+	if len(project.Tracks) == 0 {
+		return audio{}, errors.New("project has no audio tracks")
+	}
+
+	dataDir := filepath.Join(filepath.Dir(aupPath), project.Name)
+	blockFiles, err := findBlockFiles(dataDir)
+	if err != nil {
+		return audio{}, err
+	}
+
+	rate := int(project.Tracks[0].Rate)
+	numChannels := 1
+	for _, track := range project.Tracks {
+		if int(track.Rate) != rate {
+			return audio{}, errors.New("tracks with different sample rates are not supported")
+		}
+		if track.Channel != monoChannel {
+			numChannels = 2
+		}
+	}
+
+	result := audio{rate: rate, channels: make([][]float32, numChannels)}
+	for _, track := range project.Tracks {
+		if track.Mute != 0 {
+			continue
+		}
+		samples, err := readTrack(track, rate, blockFiles, dataDir)
+		if err != nil {
+			return audio{}, err
+		}
+
+		var targets []int
+		switch {
+		case numChannels == 1:
+			targets = []int{0}
+		case track.Channel == leftChannel:
+			targets = []int{0}
+		case track.Channel == rightChannel:
+			targets = []int{1}
+		default:
+			targets = []int{0, 1}
+		}
+		for _, t := range targets {
+			channel := result.channels[t]
+			if len(samples) > len(channel) {
+				channel = append(channel, make([]float32, len(samples)-len(channel))...)
+			}
+			for i, s := range samples {
+				channel[i] += s
+			}
+			result.channels[t] = channel
+		}
+	}
+
+	// All channels must have the same length.
+	length := 0
+	for _, channel := range result.channels {
+		length = maxInt(length, len(channel))
+	}
+	for i, channel := range result.channels {
+		result.channels[i] = append(channel, make([]float32, length-len(channel))...)
+	}
+
+	return result, nil
+}
+
+func decodeSample(data []byte, order binary.ByteOrder, encoding string) float32 {
+	switch encoding {
+	case "u8":
+		return (float32(data[0]) - 128) / 128
+	case "s8":
+		return float32(int8(data[0])) / 128
+	case "s16":
+		return float32(int16(order.Uint16(data))) / 32768
+	case "s24":
+		var v int32
+		if order == binary.BigEndian {
+			v = int32(data[0])<<24 | int32(data[1])<<16 | int32(data[2])<<8
+		} else {
+			v = int32(data[2])<<24 | int32(data[1])<<16 | int32(data[0])<<8
+		}
+		return float32(v) / 2147483648
+	case "s32":
+		return float32(int32(order.Uint32(data))) / 2147483648
+	case "f32":
+		return math.Float32frombits(order.Uint32(data))
+	}
+	panic("unknown sample encoding " + encoding)
+}
+
+var sampleSizes = map[string]int{"u8": 1, "s8": 1, "s16": 2, "s24": 3, "s32": 4, "f32": 4}
+
+// decodeSamples decodes interleaved samples into one slice per
+// channel.
+func decodeSamples(data []byte, order binary.ByteOrder, encoding string, numChannels int) [][]float32 {
+	size := sampleSizes[encoding]
+	frameSize := size * numChannels
+	numFrames := len(data) / frameSize
+
+	channels := make([][]float32, numChannels)
+	for c := range channels {
+		channels[c] = make([]float32, numFrames)
+	}
+	for i := 0; i < numFrames; i++ {
+		frame := data[i*frameSize : (i+1)*frameSize]
+		for c := range channels {
+			channels[c][i] = decodeSample(frame[c*size:(c+1)*size], order, encoding)
+		}
+	}
+	return channels
+}
+
+// readAU reads a Sun/NeXT audio file, which is what Audacity stores
+// its blocks in.  Audacity writes them in native byte order and keeps
+// summary data between the header and the samples.
+func readAU(path string) ([]float32, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 24 {
+		return nil, 0, errors.New("file too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(data[0:4]) {
+	case ".snd":
+		order = binary.BigEndian
+	case "dns.":
+		order = binary.LittleEndian
+	default:
+		return nil, 0, errors.New("not an AU file")
+	}
+
+	offset := int(order.Uint32(data[4:8]))
+	size := int(order.Uint32(data[8:12]))
+	rate := int(order.Uint32(data[16:20]))
+	channels := int(order.Uint32(data[20:24]))
+
+	var encoding string
+	switch order.Uint32(data[12:16]) {
+	case 2:
+		encoding = "s8"
+	case 3:
+		encoding = "s16"
+	case 4:
+		encoding = "s24"
+	case 5:
+		encoding = "s32"
+	case 6:
+		encoding = "f32"
+	default:
+		return nil, 0, fmt.Errorf("unsupported AU encoding %d", order.Uint32(data[12:16]))
+	}
+
+	if offset > len(data) || channels < 1 {
+		return nil, 0, errors.New("corrupt AU header")
+	}
+	end := len(data)
+	if size != 0xffffffff && offset+size < end {
+		end = offset + size
+	}
+
+	// Audacity's blocks are always mono, but other AU files
+	// might not be.
+	return audio{rate: rate, channels: decodeSamples(data[offset:end], order, encoding, channels)}.mono(), rate, nil
+}
+
+func readWAV(path string) (audio, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return audio{}, err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return audio{}, errors.New("not a WAV file")
+	}
+
+	var format, channels, bits int
+	var rate int
+	var samples []byte
+	haveFormat := false
+	reader := bytes.NewReader(data[12:])
+	for {
+		var header struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return audio{}, err
+		}
+		// Some writers get the size of the last chunk wrong.
+		size := int(header.Size)
+		if size > reader.Len() {
+			if string(header.ID[:]) != "data" {
+				return audio{}, io.ErrUnexpectedEOF
+			}
+			size = reader.Len()
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return audio{}, err
+		}
+		if header.Size%2 == 1 {
+			reader.ReadByte()
+		}
+
+		switch string(header.ID[:]) {
+		case "fmt ":
+			if len(chunk) < 16 {
+				return audio{}, errors.New("corrupt WAV format chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(chunk[0:2]))
+			channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+			rate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+			bits = int(binary.LittleEndian.Uint16(chunk[14:16]))
+			// WAVE_FORMAT_EXTENSIBLE has the actual format in
+			// the sub-format GUID.
+			if format == 0xfffe && len(chunk) >= 26 {
+				format = int(binary.LittleEndian.Uint16(chunk[24:26]))
+			}
+			haveFormat = true
+		case "data":
+			samples = chunk
+		}
+	}
+	if !haveFormat || samples == nil {
+		return audio{}, errors.New("WAV file without format or data")
+	}
+
+	var encoding string
+	switch {
+	case format == 1 && bits == 8:
+		encoding = "u8"
+	case format == 1 && bits == 16:
+		encoding = "s16"
+	case format == 1 && bits == 24:
+		encoding = "s24"
+	case format == 1 && bits == 32:
+		encoding = "s32"
+	case format == 3 && bits == 32:
+		encoding = "f32"
+	default:
+		return audio{}, fmt.Errorf("unsupported WAV format %d with %d bits", format, bits)
+	}
+	if channels < 1 {
+		return audio{}, errors.New("WAV file without channels")
+	}
+
+	return audio{rate: rate, channels: decodeSamples(samples, binary.LittleEndian, encoding, channels)}, nil
+}
+
+// loadAudio reads a WAV file if one is given, or otherwise the audio
+// of the Audacity project.
+func loadAudio(wavPath string, aupPath string) (audio, error) {
+	if wavPath != "" {
+		return readWAV(wavPath)
+	}
+	if aupPath == "" {
+		return audio{}, errors.New("no audio given - use `-audio` or `-audacity`")
+	}
+	return readProjectAudio(aupPath)
+}
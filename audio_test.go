@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAU writes mono float samples the way Audacity does, in the
+// given byte order with some summary data before the samples.
+func writeAU(t *testing.T, path string, order binary.ByteOrder, rate int, samples []float32) {
+	const summary = 40
+	header := make([]byte, 24+summary)
+	magic := ".snd"
+	if order == binary.LittleEndian {
+		magic = "dns."
+	}
+	copy(header, magic)
+	order.PutUint32(header[4:8], uint32(len(header)))
+	order.PutUint32(header[8:12], 0xffffffff)
+	order.PutUint32(header[12:16], 6)
+	order.PutUint32(header[16:20], uint32(rate))
+	order.PutUint32(header[20:24], 1)
+
+	data := header
+	for _, s := range samples {
+		var bytes [4]byte
+		order.PutUint32(bytes[:], math.Float32bits(s))
+		data = append(data, bytes[:]...)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAU(t *testing.T) {
+	samples := []float32{0, 0.5, -0.25, 1, -1}
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		path := filepath.Join(t.TempDir(), "block.au")
+		writeAU(t, path, order, 22050, samples)
+		got, rate, err := readAU(path)
+		if err != nil {
+			t.Errorf("%s: %s", order, err.Error())
+			continue
+		}
+		if rate != 22050 || fmt.Sprint(got) != fmt.Sprint(samples) {
+			t.Errorf("%s: got %v at %d", order, got, rate)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.au")
+	os.WriteFile(path, []byte("RIFF0000WAVEfmt 0000000000000000"), 0644)
+	if _, _, err := readAU(path); err == nil || err.Error() != "not an AU file" {
+		t.Errorf("WAV file: got error %v", err)
+	}
+}
+
+func TestDecodeSample(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		encoding string
+		want     float32
+	}{
+		{[]byte{0}, "u8", -1},
+		{[]byte{192}, "u8", 0.5},
+		{[]byte{0x80}, "s8", -1},
+		{[]byte{0x40, 0x00}, "s16", 0.5},
+		{[]byte{0xc0, 0x00, 0x00}, "s24", -0.5},
+		{[]byte{0x20, 0x00, 0x00, 0x00}, "s32", 0.25},
+		{[]byte{0x3f, 0x00, 0x00, 0x00}, "f32", 0.5},
+	}
+	for _, test := range tests {
+		if got := decodeSample(test.data, binary.BigEndian, test.encoding); got != test.want {
+			t.Errorf("%s %v: got %v, want %v", test.encoding, test.data, got, test.want)
+		}
+	}
+}
+
+const testProject = `<?xml version="1.0" standalone="no" ?>
+<project xmlns="http://audacity.sourceforge.net/xml/" projname="show_data" rate="10">
+	<wavetrack name="Left" channel="0" linked="1" mute="0" rate="10" gain="0.5">
+		<waveclip offset="0.2">
+			<sequence>
+				<waveblock start="0"><simpleblockfile filename="e0001.au" len="3"/></waveblock>
+				<waveblock start="3"><silentblockfile len="2"/></waveblock>
+				<waveblock start="5"><simpleblockfile filename="e0002.au" len="1"/></waveblock>
+			</sequence>
+		</waveclip>
+	</wavetrack>
+	<wavetrack name="Right" channel="1" linked="0" mute="0" rate="10">
+		<waveclip offset="0">
+			<sequence>
+				<waveblock start="0"><simpleblockfile filename="e0003.au" len="2"/></waveblock>
+			</sequence>
+		</waveclip>
+	</wavetrack>
+	<wavetrack name="Voice" channel="2" mute="0" rate="10">
+		<waveclip offset="0.1">
+			<sequence>
+				<waveblock start="0"><simpleblockfile filename="e0003.au" len="1"/></waveblock>
+			</sequence>
+		</waveclip>
+	</wavetrack>
+	<wavetrack name="Muted" channel="2" mute="1" rate="10">
+		<waveclip offset="0">
+			<sequence>
+				<waveblock start="0"><simpleblockfile filename="e0001.au" len="3"/></waveblock>
+			</sequence>
+		</waveclip>
+	</wavetrack>
+</project>
+`
+
+func TestReadProjectAudio(t *testing.T) {
+	dir := t.TempDir()
+	writeAU(t, filepath.Join(dir, "show_data", "e00", "d00", "e0001.au"), binary.LittleEndian, 10, []float32{0.5, 0.5, 0.5, 0.5})
+	writeAU(t, filepath.Join(dir, "show_data", "e00", "d01", "e0002.au"), binary.BigEndian, 10, []float32{-1})
+	writeAU(t, filepath.Join(dir, "show_data", "e01", "d00", "e0003.au"), binary.LittleEndian, 10, []float32{0.25, 0.125})
+	aupPath := filepath.Join(dir, "show.aup")
+	if err := os.WriteFile(aupPath, []byte(testProject), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := readProjectAudio(aupPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := []string{
+		"[0 0.25 0.25 0.25 0.25 0 0 -0.5]",
+		"[0.25 0.375 0 0 0 0 0 0]",
+	}
+	if a.rate != 10 || len(a.channels) != 2 {
+		t.Fatalf("got %d channels at %d", len(a.channels), a.rate)
+	}
+	for i, channel := range a.channels {
+		if fmt.Sprint(channel) != want[i] {
+			t.Errorf("channel %d: got %v, want %s", i, channel, want[i])
+		}
+	}
+
+	broken := strings.Replace(testProject, "e0002.au", "e0004.au", 1)
+	if err := os.WriteFile(aupPath, []byte(broken), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readProjectAudio(aupPath); err == nil || !strings.Contains(err.Error(), "block file `e0004.au` not found") {
+		t.Errorf("missing block file: got error %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// The onset envelope has one value per hundredth of a second, which is
+// the resolution of the club's timer, so beat times come out directly
+// in the units of our programs.
+const onsetFrameRate = 100
+
+// onsetEnvelope computes how much the loudness increases from frame to
+// frame, for the whole signal and for the bass, which is where most
+// beats are.
+func onsetEnvelope(a audio) []float64 {
+	hop := a.rate / onsetFrameRate
+	if hop < 1 {
+		hop = 1
+	}
+	samples := a.mono()
+	numFrames := len(samples) / hop
+
+	// A one-pole low-pass at about 150Hz.
+	lowCoefficient := 1 - math.Exp(-2*math.Pi*150/float64(a.rate))
+	low := 0.0
+
+	var previousFull, previousLow float64
+	onsets := make([]float64, numFrames)
+	for f := 0; f < numFrames; f++ {
+		var full, lowEnergy float64
+		for _, s := range samples[f*hop : (f+1)*hop] {
+			x := float64(s)
+			low += lowCoefficient * (x - low)
+			full += x * x
+			lowEnergy += low * low
+		}
+		full = math.Log(1e-6 + full/float64(hop))
+		lowEnergy = math.Log(1e-6 + lowEnergy/float64(hop))
+
+		if f > 0 {
+			onsets[f] = math.Max(0, full-previousFull) + math.Max(0, lowEnergy-previousLow)
+		}
+		previousFull = full
+		previousLow = lowEnergy
+	}
+
+	// Subtract the local average so that only onsets that stick out
+	// remain, then normalize.
+	const window = onsetFrameRate / 4
+	normalized := make([]float64, numFrames)
+	var sum, sumSquares float64
+	for f := range onsets {
+		from := f - window
+		if from < 0 {
+			from = 0
+		}
+		to := f + window
+		if to > numFrames {
+			to = numFrames
+		}
+		mean := 0.0
+		for _, o := range onsets[from:to] {
+			mean += o
+		}
+		mean /= float64(to - from)
+		normalized[f] = math.Max(0, onsets[f]-mean)
+		sum += normalized[f]
+		sumSquares += normalized[f] * normalized[f]
+	}
+	if numFrames > 0 {
+		mean := sum / float64(numFrames)
+		deviation := math.Sqrt(sumSquares/float64(numFrames) - mean*mean)
+		if deviation > 0 {
+			for f := range normalized {
+				normalized[f] /= deviation
+			}
+		}
+	}
+	return normalized
+}
+
+// estimateBeatPeriod finds the period, in frames, at which the onset
+// envelope repeats best, preferring tempos around 120 BPM.
+func estimateBeatPeriod(onsets []float64) int {
+	const minPeriod = 60 * onsetFrameRate / 200
+	const maxPeriod = 60 * onsetFrameRate / 60
+	const preferredPeriod = 60 * onsetFrameRate / 120
+
+	bestPeriod := preferredPeriod
+	bestScore := -1.0
+	for period := minPeriod; period <= maxPeriod && period < len(onsets); period++ {
+		correlation := 0.0
+		for f := period; f < len(onsets); f++ {
+			correlation += onsets[f] * onsets[f-period]
+		}
+		correlation /= float64(len(onsets) - period)
+
+		octaves := math.Log2(float64(period) / preferredPeriod)
+		score := correlation * math.Exp(-0.5*octaves*octaves)
+		if score > bestScore {
+			bestScore = score
+			bestPeriod = period
+		}
+	}
+	return bestPeriod
+}
+
+// trackBeats picks beats that lie on strong onsets while keeping close
+// to the given period, using dynamic programming as described by Dan
+// Ellis in "Beat Tracking by Dynamic Programming".
+func trackBeats(onsets []float64, period int) []int {
+	const tightness = 100.0
+
+	scores := make([]float64, len(onsets))
+	previous := make([]int, len(onsets))
+	for t := range onsets {
+		best := 0.0
+		previous[t] = -1
+		for p := t - 2*period; p <= t-period/2; p++ {
+			if p < 0 {
+				continue
+			}
+			deviation := math.Log(float64(t-p) / float64(period))
+			score := scores[p] - tightness*deviation*deviation
+			if previous[t] < 0 || score > best {
+				best = score
+				previous[t] = p
+			}
+		}
+		if previous[t] >= 0 && best > 0 {
+			scores[t] = onsets[t] + best
+		} else {
+			scores[t] = onsets[t]
+			previous[t] = -1
+		}
+	}
+
+	last := len(onsets) - 1
+	for t := len(onsets) - period; t < len(onsets); t++ {
+		if t >= 0 && (last < 0 || scores[t] > scores[last]) {
+			last = t
+		}
+	}
+
+	var beats []int
+	for t := last; t >= 0; t = previous[t] {
+		beats = append([]int{t}, beats...)
+	}
+	return beats
+}
+
+func detectBeats(a audio) ([]int, int) {
+	onsets := onsetEnvelope(a)
+	if len(onsets) == 0 {
+		return nil, 0
+	}
+	period := estimateBeatPeriod(onsets)
+	return trackBeats(onsets, period), period
+}
+
+// beatLabels makes a label `beatN` for every beat, lasting until the
+// next one, and if downbeatEvery isn't zero, a label `downbeatN` for
+// every bar, counting from the first beat.
+func beatLabels(beats []int, period int, downbeatEvery int) []label {
+	var labels []label
+	end := func(i int, step int) int {
+		if i+step < len(beats) {
+			return beats[i+step]
+		}
+		return beats[i] + step*period
+	}
+
+	for i, b := range beats {
+		labels = append(labels, label{name: "beat" + strconv.Itoa(i+1), timelineName: "beat", start: b, end: end(i, 1), beat: true})
+	}
+	if downbeatEvery > 0 {
+		for i := 0; i < len(beats); i += downbeatEvery {
+			n := i/downbeatEvery + 1
+			labels = append(labels, label{name: "downbeat" + strconv.Itoa(n), timelineName: "downbeat", start: beats[i], end: end(i, downbeatEvery), beat: true})
+		}
+	}
+	return labels
+}
+
+// fitBeats fits the beat labels of a sorted timeline around the other
+// labels, so they don't collide.  Beat labels only play if there's a
+// color or sub with their name.  They're left out if they start during
+// a label from Audacity, and beats are left out if they start together
+// with a downbeat.  The others last until the next label starts, so a
+// downbeat only replaces the beat it falls on.
+func (ls timeline) fitBeats(colors map[string]color, subs map[string]sub) timeline {
+	plays := func(l label) bool {
+		if !l.beat {
+			return true
+		}
+		ok, _, _ := lookupColor(colors, l.timelineName)
+		_, isSub := subs[l.timelineName]
+		return ok || isSub
+	}
+	covers := func(other label, l label) bool {
+		if other.beat {
+			return other.timelineName == "downbeat" && l.timelineName == "beat" && other.start == l.start && plays(other)
+		}
+		return other.start <= l.start && (l.start < other.end || other.start == l.start)
+	}
+
+	var fitted timeline
+	for i, l := range ls {
+		if !l.beat {
+			fitted = append(fitted, l)
+			continue
+		}
+		if !plays(l) {
+			continue
+		}
+		covered := false
+		for _, other := range ls {
+			if covers(other, l) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+
+		for _, next := range ls[i+1:] {
+			if next.start > l.start && plays(next) {
+				if next.start < l.end {
+					l.end = next.start
+				}
+				break
+			}
+		}
+		fitted = append(fitted, l)
+	}
+	return fitted
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestBeatLabelsInTimeline(t *testing.T) {
+	beats := []int{100, 150, 200, 250, 300, 350, 400, 450, 500}
+	source := "COLOR,white,255,255,255\nCOLOR,red,255,0,0\nCOLOR,beat,0,0,80\nCOLOR,downbeat,80,0,0\n"
+
+	tests := []struct {
+		name      string
+		source    string
+		downbeats int
+		labels    []label
+		want      string
+	}{
+		{
+			name:   "beats",
+			source: source,
+			want:   "D,100 C,0,0,80 D,50 C,0,0,0 C,0,0,80 D,50",
+		},
+		{
+			name:      "beats and downbeats",
+			source:    source,
+			downbeats: 4,
+			want:      "D,100 C,80,0,0 D,50 C,0,0,0 C,0,0,80 D,50 C,0,0,0 C,0,0,80 D,50 C,0,0,0 C,0,0,80 D,50 C,0,0,0 C,80,0,0 D,50",
+		},
+		{
+			name:      "labels from Audacity",
+			source:    source,
+			downbeats: 4,
+			labels:    []label{{name: "red", start: 140, end: 260}},
+			want:      "D,100 C,80,0,0 D,40 C,0,0,0 C,255,0,0 D,120 C,0,0,0 D,40 C,80,0,0 D,50 C,0,0,0 C,0,0,80 D,50",
+		},
+		{
+			name:      "undefined beats",
+			source:    "COLOR,red,255,0,0\n",
+			downbeats: 4,
+			labels:    []label{{name: "red", start: 140, end: 260}},
+			want:      "D,140 C,255,0,0 D,120 C,0,0,0 END",
+		},
+	}
+
+	for _, test := range tests {
+		labels := append(test.labels, beatLabels(beats, 50, test.downbeats)...)
+		p, err := compileSource(test.source, labels, options{timeline: true}, 0)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		got := strings.Join(programLines(p), " ")
+		if !strings.Contains(got, test.want) {
+			t.Errorf("%s: got `%s`, want it to contain `%s`", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExtendMarkers(t *testing.T) {
+	ls := timeline{
+		{name: "red", start: 0, end: 0},
+		{name: "green", start: 100, end: 200},
+		{name: "C2:blue", start: 150, end: 150},
+		{name: "white", start: 300, end: 300},
+		{name: "red", start: 400, end: 400},
+	}
+	ls.extendMarkers()
+
+	want := []string{"red 0-100", "green 100-200", "C2:blue 150-150", "white 300-400", "red 400-400"}
+	for i, l := range ls {
+		if got := fmt.Sprintf("%s %d-%d", l.name, l.start, l.end); got != want[i] {
+			t.Errorf("got `%s`, want `%s`", got, want[i])
+		}
+	}
+}
+
+// clickTrack makes stereo audio with a short, decaying low click on
+// every beat, starting at first, with times in hundredths of a second.
+func clickTrack(rate int, seconds int, first int, period int) audio {
+	samples := make([]float32, rate*seconds)
+	for beat := first; beat < seconds*onsetFrameRate; beat += period {
+		start := beat * rate / onsetFrameRate
+		for i := 0; i < rate/20 && start+i < len(samples); i++ {
+			decay := math.Exp(-float64(i) / float64(rate/100))
+			samples[start+i] = float32(0.8 * decay * math.Sin(2*math.Pi*80*float64(i)/float64(rate)))
+		}
+	}
+	return audio{rate: rate, channels: [][]float32{samples, samples}}
+}
+
+func TestDetectBeats(t *testing.T) {
+	for _, period := range []int{40, 50, 75} {
+		beats, detected := detectBeats(clickTrack(8000, 12, 30, period))
+		if detected < period-1 || detected > period+1 {
+			t.Errorf("period %d: detected %d", period, detected)
+			continue
+		}
+		if len(beats) < 12*onsetFrameRate/period-2 {
+			t.Errorf("period %d: only %d beats", period, len(beats))
+		}
+		for _, b := range beats {
+			offset := (b - 30) % period
+			if b < 30-2 || (offset > 2 && offset < period-2) {
+				t.Errorf("period %d: beat at %d isn't on a click", period, b)
+			}
+		}
+	}
+
+	if beats, period := detectBeats(audio{rate: 8000, channels: [][]float32{{}}}); beats != nil || period != 0 {
+		t.Errorf("no audio: got beats %v with period %d", beats, period)
+	}
+}
+
+func TestBeatLabels(t *testing.T) {
+	var got []string
+	for _, l := range beatLabels([]int{10, 60, 110, 160, 210}, 50, 2) {
+		got = append(got, fmt.Sprintf("%s/%s %d-%d", l.name, l.timelineName, l.start, l.end))
+		if !l.beat {
+			t.Errorf("%s isn't marked as a beat", l.name)
+		}
+	}
+	want := "beat1/beat 10-60 beat2/beat 60-110 beat3/beat 110-160 beat4/beat 160-210 beat5/beat 210-260 " +
+		"downbeat1/downbeat 10-110 downbeat2/downbeat 110-210 downbeat3/downbeat 210-310"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got  %s\nwant %s", strings.Join(got, " "), want)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// clubSelector is the meaning of the club list of a `CLUBS` command
+// or a timeline label prefix.
+type clubSelector struct {
+	matches func(club int) bool
+	// highest is the highest club number mentioned explicitly.
+	highest int
+	// bounded is whether the selector matches no club beyond
+	// highest.
+	bounded bool
+}
+
+var allClubs = clubSelector{matches: func(int) bool { return true }}
+
+// members returns the clubs matched by the selector, in order.  Unless
+// the selector is bounded the total number of clubs must be known.
+func (s clubSelector) members(clubs int, lineNo int) []int {
+	limit := s.highest
+	if clubs > 0 {
+		limit = clubs
+	} else if !s.bounded {
+		errorExit(lineNo, "The number of clubs must be given with `-clubs` here")
+	}
+
+	var members []int
+	for club := 1; club <= limit; club++ {
+		if s.matches(club) {
+			members = append(members, club)
+		}
+	}
+	return members
+}
+
+var clubRangeRegexp = regexp.MustCompile("^(\\d+)\\s*-\\s*(\\d+)$")
+var clubNumberRegexp = regexp.MustCompile("^\\d+$")
+
+func unionSelector(a clubSelector, b clubSelector) clubSelector {
+	return clubSelector{
+		matches: func(club int) bool { return a.matches(club) || b.matches(club) },
+		highest: maxInt(a.highest, b.highest),
+		bounded: a.bounded && b.bounded,
+	}
+}
+
+func exceptSelector(a clubSelector, b clubSelector) clubSelector {
+	return clubSelector{
+		matches: func(club int) bool { return a.matches(club) && !b.matches(club) },
+		highest: maxInt(a.highest, b.highest),
+		bounded: a.bounded,
+	}
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func isReservedGroupName(name string) bool {
+	switch name {
+	case "all", "odd", "even", "except":
+		return true
+	}
+	return clubRangeRegexp.MatchString(name) || clubNumberRegexp.MatchString(name)
+}
+
+func parseBaseClubSelector(word string, groups map[string]clubSelector, lineNo int) clubSelector {
+	name := strings.ToLower(word)
+	switch name {
+	case "all":
+		return allClubs
+	case "odd":
+		return clubSelector{matches: func(club int) bool { return club%2 == 1 }, highest: 1}
+	case "even":
+		return clubSelector{matches: func(club int) bool { return club%2 == 0 }, highest: 2}
+	}
+
+	if matches := clubRangeRegexp.FindStringSubmatch(word); matches != nil {
+		from := parseCount(matches[1], lineNo)
+		to := parseCount(matches[2], lineNo)
+		if from > to {
+			errorExit(lineNo, "Club range `%s` is backwards", word)
+		}
+		return clubSelector{matches: func(club int) bool { return club >= from && club <= to }, highest: to, bounded: true}
+	}
+
+	if group, ok := groups[name]; ok {
+		return group
+	}
+
+	club := parseNumber(word, lineNo)
+	if club <= 0 {
+		errorExit(lineNo, "Club must be positive")
+	}
+	return clubSelector{matches: func(c int) bool { return c == club }, highest: club, bounded: true}
+}
+
+// parseClubSelector parses one field of a club list, which is a
+// space-separated list of clubs, ranges like `1-6`, `odd`, `even`,
+// `all` or group names, optionally followed by `except` and clubs to
+// leave out.
+func parseClubSelector(field string, groups map[string]clubSelector, lineNo int) clubSelector {
+	words := strings.Fields(field)
+	if len(words) == 0 {
+		errorExit(lineNo, "Empty club specification")
+	}
+
+	var selector clubSelector
+	haveSelector := false
+	excepting := false
+	for _, w := range words {
+		if strings.ToLower(w) == "except" {
+			if !haveSelector || excepting {
+				errorExit(lineNo, "Misplaced `except` in `%s`", field)
+			}
+			excepting = true
+			continue
+		}
+
+		base := parseBaseClubSelector(w, groups, lineNo)
+		if excepting {
+			selector = exceptSelector(selector, base)
+		} else if haveSelector {
+			selector = unionSelector(selector, base)
+		} else {
+			selector = base
+			haveSelector = true
+		}
+	}
+	return selector
+}
+
+func parseClubSelectors(fields []string, groups map[string]clubSelector, lineNo int) clubSelector {
+	if len(fields) == 0 {
+		errorExit(lineNo, "No clubs given")
+	}
+	selector := parseClubSelector(fields[0], groups, lineNo)
+	for _, f := range fields[1:len(fields)] {
+		selector = unionSelector(selector, parseClubSelector(f, groups, lineNo))
+	}
+	return selector
+}
+
+func gatherGroupsInCommands(cs []command, groups map[string]clubSelector) {
+	for _, c := range cs {
+		switch c.fields[0] {
+		case "GROUP":
+			if len(c.fields) < 3 {
+				errorExit(c.lineNo, "GROUP needs a name and clubs")
+			}
+			name := strings.ToLower(c.fields[1])
+			if isReservedGroupName(name) {
+				errorExit(c.lineNo, "`%s` can't be used as a group name", c.fields[1])
+			}
+			_, ok := groups[name]
+			if ok {
+				errorExit(c.lineNo, "Group `%s` redefined", name)
+			}
+			groups[name] = parseClubSelectors(c.fields[2:len(c.fields)], groups, c.lineNo)
+		default:
+			if c.hasSubCommands() {
+				gatherGroupsInCommands(c.subCommands, groups)
+			}
+		}
+	}
+}
+
+func (p program) gatherGroups() map[string]clubSelector {
+	groups := make(map[string]clubSelector)
+	gatherGroupsInCommands(p, groups)
+	return groups
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestClubSelectors(t *testing.T) {
+	groups := parseProgram(strings.NewReader("GROUP,left,1-3\nGROUP,Right,4 5 6\nGROUP,ends,1,right except 4-5\n")).gatherGroups()
+	tests := []struct {
+		fields string
+		clubs  int
+		want   []int
+	}{
+		{"3", 0, []int{3}},
+		{"2-4", 0, []int{2, 3, 4}},
+		{"1,3 5", 0, []int{1, 3, 5}},
+		{"odd", 6, []int{1, 3, 5}},
+		{"even except 4", 8, []int{2, 6, 8}},
+		{"all except 2-7", 8, []int{1, 8}},
+		{"LEFT", 0, []int{1, 2, 3}},
+		{"right", 8, []int{4, 5, 6}},
+		{"ends", 0, []int{1, 6}},
+		{"left except odd", 0, []int{2}},
+		{"2-4", 3, []int{2, 3}},
+	}
+
+	for _, test := range tests {
+		selector := parseClubSelectors(strings.Split(test.fields, ","), groups, 0)
+		got := selector.members(test.clubs, 0)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s with %d clubs: got %v, want %v", test.fields, test.clubs, got, test.want)
+		}
+	}
+}
+
+func TestClubSelectorErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"CLUBS,4-2\nE\n", "Club range `4-2` is backwards"},
+		{"CLUBS,0\nE\n", "Club must be positive"},
+		{"CLUBS,except 2\nE\n", "Misplaced `except` in `except 2`"},
+		{"CLUBS,1 except 2 except 3\nE\n", "Misplaced `except`"},
+		{"CLUBS,\nE\n", "Empty club specification"},
+		{"CLUBS,nobody\nE\n", "Cannot parse number `nobody`"},
+		{"GROUP,odd,1 3\n", "`odd` can't be used as a group name"},
+		{"GROUP,7,1 3\n", "`7` can't be used as a group name"},
+		{"GROUP,left,1\nGROUP,Left,2\n", "Group `left` redefined"},
+		{"GROUP,left\n", "GROUP needs a name and clubs"},
+		{"CLUBS,odd\nE\n", "must be given with `-clubs`"},
+	}
+
+	for _, test := range tests {
+		_, err := compileSource(test.source, nil, options{}, 0)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %v, want `%s`", test.source, err, test.want)
+		}
+	}
+}
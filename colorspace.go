@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+)
+
+// interpolation returns the color at position t, between 0 and 1, on
+// the way from one color to another.
+type interpolation func(from color, to color, t float64) color
+
+var colorSpaces = map[string]interpolation{
+	"rgb":   interpolateRGB,
+	"hsv":   interpolateHSV,
+	"oklab": interpolateOKLab,
+}
+
+func lerp(a float64, b float64, t float64) float64 {
+	return a + (b-a)*t
+}
+
+func clampComponent(x float64) int {
+	v := int(math.Floor(x + 0.5))
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return v
+}
+
+func interpolateRGB(from color, to color, t float64) color {
+	return color{
+		r: clampComponent(lerp(float64(from.r), float64(to.r), t)),
+		g: clampComponent(lerp(float64(from.g), float64(to.g), t)),
+		b: clampComponent(lerp(float64(from.b), float64(to.b), t)),
+	}
+}
+
+func (c color) hsv() (h float64, s float64, v float64) {
+	r := float64(c.r) / 255
+	g := float64(c.g) / 255
+	b := float64(c.b) / 255
+
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	v = max
+	if max > 0 {
+		s = delta / max
+	}
+	if delta == 0 {
+		return 0, s, v
+	}
+
+	switch max {
+	case r:
+		h = math.Mod((g-b)/delta, 6)
+	case g:
+		h = (b-r)/delta + 2
+	default:
+		h = (r-g)/delta + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, s, v
+}
+
+func colorFromHSV(h float64, s float64, v float64) color {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return color{
+		r: clampComponent((r + m) * 255),
+		g: clampComponent((g + m) * 255),
+		b: clampComponent((b + m) * 255),
+	}
+}
+
+func interpolateHSV(from color, to color, t float64) color {
+	h1, s1, v1 := from.hsv()
+	h2, s2, v2 := to.hsv()
+
+	// Grays and black don't have a meaningful hue, so we take the
+	// hue from the other end instead of sweeping through red.
+	if s1 == 0 || v1 == 0 {
+		h1 = h2
+	}
+	if s2 == 0 || v2 == 0 {
+		h2 = h1
+	}
+
+	// Take the short way around the color wheel.
+	if h2-h1 > 180 {
+		h1 += 360
+	} else if h1-h2 > 180 {
+		h2 += 360
+	}
+
+	return colorFromHSV(lerp(h1, h2, t), lerp(s1, s2, t), lerp(v1, v2, t))
+}
+
+func srgbToLinear(x int) float64 {
+	c := float64(x) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(x float64) int {
+	if x <= 0.0031308 {
+		return clampComponent(x * 12.92 * 255)
+	}
+	return clampComponent((1.055*math.Pow(x, 1/2.4) - 0.055) * 255)
+}
+
+// See https://bottosson.github.io/posts/oklab/
+func (c color) oklab() (l float64, a float64, b float64) {
+	r := srgbToLinear(c.r)
+	g := srgbToLinear(c.g)
+	bl := srgbToLinear(c.b)
+
+	lc := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*bl)
+	mc := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*bl)
+	sc := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*bl)
+
+	l = 0.2104542553*lc + 0.7936177850*mc - 0.0040720468*sc
+	a = 1.9779984951*lc - 2.4285922050*mc + 0.4505937099*sc
+	b = 0.0259040371*lc + 0.7827717662*mc - 0.8086757660*sc
+	return l, a, b
+}
+
+func colorFromOKLab(l float64, a float64, b float64) color {
+	lc := l + 0.3963377774*a + 0.2158037573*b
+	mc := l - 0.1055613458*a - 0.0638541728*b
+	sc := l - 0.0894841775*a - 1.2914855480*b
+
+	lc = lc * lc * lc
+	mc = mc * mc * mc
+	sc = sc * sc * sc
+
+	return color{
+		r: linearToSRGB(4.0767416621*lc - 3.3077115913*mc + 0.2309699292*sc),
+		g: linearToSRGB(-1.2684380046*lc + 2.6097574011*mc - 0.3413193965*sc),
+		b: linearToSRGB(-0.0041960863*lc - 0.7034186147*mc + 1.7076147010*sc),
+	}
+}
+
+func interpolateOKLab(from color, to color, t float64) color {
+	l1, a1, b1 := from.oklab()
+	l2, a2, b2 := to.oklab()
+	return colorFromOKLab(lerp(l1, l2, t), lerp(a1, a2, t), lerp(b1, b2, t))
+}
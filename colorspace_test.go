@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testColors = []color{
+	{0, 0, 0}, {255, 255, 255}, {128, 128, 128},
+	{255, 0, 0}, {0, 255, 0}, {0, 0, 255},
+	{255, 128, 0}, {12, 200, 180}, {90, 30, 200}, {1, 2, 3},
+}
+
+func TestColorSpaceRoundTrips(t *testing.T) {
+	for _, c := range testColors {
+		if got := colorFromHSV(c.hsv()); got != c {
+			t.Errorf("HSV: %v comes back as %v", c, got)
+		}
+		if got := colorFromOKLab(c.oklab()); got != c {
+			t.Errorf("OKLab: %v comes back as %v", c, got)
+		}
+	}
+}
+
+func TestInterpolationEnds(t *testing.T) {
+	for name, interpolate := range colorSpaces {
+		for _, from := range testColors {
+			for _, to := range testColors {
+				if got := interpolate(from, to, 0); got != from {
+					t.Errorf("%s from %v to %v starts at %v", name, from, to, got)
+				}
+				if got := interpolate(from, to, 1); got != to {
+					t.Errorf("%s from %v to %v ends at %v", name, from, to, got)
+				}
+			}
+		}
+	}
+}
+
+func TestInterpolateHSV(t *testing.T) {
+	tests := []struct {
+		from, to color
+		want     color
+	}{
+		// The short way from red to blue is through magenta, not green.
+		{color{255, 0, 0}, color{0, 0, 255}, color{255, 0, 255}},
+		{color{0, 0, 255}, color{255, 0, 0}, color{255, 0, 255}},
+		// Black and white take the hue of the other end.
+		{color{0, 0, 0}, color{0, 255, 0}, color{64, 128, 64}},
+		{color{255, 255, 255}, color{0, 0, 255}, color{128, 128, 255}},
+	}
+
+	for _, test := range tests {
+		if got := interpolateHSV(test.from, test.to, 0.5); got != test.want {
+			t.Errorf("halfway from %v to %v: got %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+}
+
+func TestGradientCommands(t *testing.T) {
+	colors := map[string]color{"black": {0, 0, 0}, "white": {255, 255, 255}}
+	c := command{fields: []string{"GRADIENT", "black", "white", "10", "3", "RGB"}, lineNo: 2}
+
+	var got []string
+	for _, gc := range gradientCommands(c, colors) {
+		got = append(got, strings.Join(gc.fields, ","))
+		if gc.lineNo != c.lineNo {
+			t.Errorf("`%s` is from line %d", gc.line(), gc.lineNo+1)
+		}
+	}
+	want := "C,0,0,0 RAMP,85,85,85,3 RAMP,170,170,170,3 RAMP,255,255,255,4"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got `%s`, want `%s`", strings.Join(got, " "), want)
+	}
+}
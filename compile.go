@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// options are the settings from the command line that decide how
+// programs are compiled.
+type options struct {
+	audacity   string
+	audio      string
+	input      string
+	output     string
+	beats      bool
+	downbeats  int
+	club       int
+	clubs      int
+	timeline   bool
+	limits     sizeLimits
+	sizeWarn   bool
+	optimize   bool
+	timePolicy timePolicy
+	format     string
+	sourceMap  string
+	printing   printOptions
+}
+
+// compileError is what errorExit panics with, so that compileAll can
+// report it instead of the whole program exiting.
+type compileError struct {
+	message string
+}
+
+func (e compileError) Error() string {
+	return e.message
+}
+
+// project is everything a program is compiled from.
+type project struct {
+	input  program
+	labels []label
+	audio  *audio
+}
+
+func loadProject(opts options) (project, error) {
+	var proj project
+	if opts.audacity != "" {
+		file, err := os.Open(opts.audacity)
+		if err != nil {
+			return proj, fmt.Errorf("Error: Can't open audacity file `%s`: %s", opts.audacity, err.Error())
+		}
+		defer file.Close()
+
+		proj.labels, err = readLabels(file)
+		if err != nil {
+			return proj, fmt.Errorf("Error reading Audacity file `%s`: %s", opts.audacity, err.Error())
+		}
+	}
+
+	inFile := os.Stdin
+	if opts.input != "-" {
+		var err error
+		inFile, err = os.Open(opts.input)
+		if err != nil {
+			return proj, fmt.Errorf("Error opening input file `%s`: %s", opts.input, err.Error())
+		}
+		defer inFile.Close()
+	}
+	proj.input = parseProgram(inFile)
+
+	if opts.beats || proj.input.uses("ENVELOPE") {
+		a, err := loadAudio(opts.audio, opts.audacity)
+		if err != nil {
+			return proj, fmt.Errorf("Error reading audio: %s", err.Error())
+		}
+		proj.audio = &a
+	}
+
+	if opts.beats {
+		beats, period := detectBeats(*proj.audio)
+		proj.labels = append(proj.labels, beatLabels(beats, period, opts.downbeats)...)
+	}
+	return proj, nil
+}
+
+// compile compiles the project for one club, or for no club in
+// particular if club is zero.
+func (proj project) compile(opts options, club int) program {
+	definitions := make(map[string]int)
+	if club != 0 {
+		definitions["club"] = club
+	}
+	if opts.clubs != 0 {
+		definitions["clubs"] = opts.clubs
+	}
+
+	var labelsMap map[string][]label
+
+	inputProgram := proj.input
+	groups := inputProgram.gatherGroups()
+
+	if opts.timeline {
+		labels := make([]label, len(proj.labels))
+		copy(labels, proj.labels)
+		sort.Sort(timeline(labels))
+		timeline(labels).extendMarkers()
+		colors := inputProgram.gatherColors()
+		subs := inputProgram.gatherSubs()
+		labels = timeline(labels).fitBeats(colors, subs)
+		timeline(labels).checkConsistency(groups)
+		inputProgram = timeline(labels).program(colors, subs, definitions)
+	} else {
+		labelsMap = mapFromLabels(proj.labels)
+	}
+
+	specialized := inputProgram.specializeForClub(club, opts.clubs, groups)
+	delabeled := specialized.resolveEach(labelsMap, definitions).resolveExprs(labelsMap, definitions)
+	enveloped := delabeled.resolveEnvelopes(labelsMap, proj.audio)
+	chased := enveloped.resolveChases(club, opts.clubs, groups)
+	randomized := chased.resolveRandom(club)
+	colored := randomized.resolveColor()
+	timed := colored.resolveTime(opts.timePolicy)
+	filled := timed.resolveFill()
+	finalProgram := filled
+	if opts.optimize {
+		finalProgram = filled.peephole().optimize(opts.limits)
+	}
+
+	if problems := finalProgram.checkSize(opts.limits); len(problems) > 0 {
+		prefix := "Error"
+		if opts.sizeWarn {
+			prefix = "Warning"
+		}
+		var report strings.Builder
+		for _, problem := range problems {
+			fmt.Fprintf(&report, "%s: %s\n", prefix, problem)
+		}
+		finalProgram.printSizeBreakdown(&report)
+		if !opts.sizeWarn {
+			panic(compileError{strings.TrimSuffix(report.String(), "\n")})
+		}
+		fmt.Fprint(os.Stderr, report.String())
+	}
+
+	return finalProgram
+}
+
+// compiledClubs are the clubs we compile for.  With `-clubs` and an
+// output path containing `%d` but no `-club` that's all of them, each
+// with its own output file.
+func (opts options) compiledClubs() []int {
+	if opts.club != 0 || opts.clubs == 0 || !strings.Contains(opts.output, "%d") {
+		return []int{opts.club}
+	}
+	var clubs []int
+	for club := 1; club <= opts.clubs; club++ {
+		clubs = append(clubs, club)
+	}
+	return clubs
+}
+
+func (opts options) outputPath(club int) string {
+	return strings.Replace(opts.output, "%d", strconv.Itoa(club), -1)
+}
+
+// compileAll compiles the programs for all clubs we compile for,
+// returning the first error.
+func compileAll(opts options) (programs map[int]program, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(compileError)
+			if !ok {
+				panic(r)
+			}
+			programs = nil
+			err = e
+		}
+	}()
+
+	proj, err := loadProject(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	programs = make(map[int]program)
+	for _, club := range opts.compiledClubs() {
+		programs[club] = proj.compile(opts, club)
+	}
+	return programs, nil
+}
+
+// outputFormats are the formats we can write programs in.
+var outputFormats = map[string]bool{"glo": true, "json": true}
+
+func writeProgram(w io.Writer, opts options, p program, club int) error {
+	if opts.format == "json" {
+		return p.writeJSON(w, club)
+	}
+	entries := p.annotateTimes(w, opts.printing)
+	if opts.sourceMap == "" {
+		return nil
+	}
+
+	inputName := opts.input
+	if inputName == "-" {
+		inputName = "stdin"
+	}
+	path := strings.Replace(opts.sourceMap, "%d", strconv.Itoa(club), -1)
+	mapFile, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Can't create source map `%s`: %s", path, err.Error())
+	}
+	writeSourceMap(mapFile, entries, inputName)
+	return mapFile.Close()
+}
+
+// writePrograms writes the programs to their output files.  Only one
+// program can go to the standard output, since several wouldn't make
+// a valid glo or JSON file.
+func writePrograms(opts options, programs map[int]program) error {
+	clubs := opts.compiledClubs()
+	if opts.output == "-" && len(clubs) > 1 {
+		return fmt.Errorf("Error: Can't write the programs for %d clubs to the standard output", len(clubs))
+	}
+	for _, club := range clubs {
+		if opts.output == "-" {
+			if err := writeProgram(os.Stdout, opts, programs[club], club); err != nil {
+				return fmt.Errorf("Error writing output: %s", err.Error())
+			}
+			continue
+		}
+
+		path := opts.outputPath(club)
+		outFile, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("Error opening output file `%s`: %s", path, err.Error())
+		}
+		err = writeProgram(outFile, opts, programs[club], club)
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("Error writing output file `%s`: %s", path, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCompiledClubs(t *testing.T) {
+	tests := []struct {
+		opts options
+		want []int
+	}{
+		{options{output: "-"}, []int{0}},
+		{options{output: "-", clubs: 3}, []int{0}},
+		{options{output: "-", club: 2, clubs: 3}, []int{2}},
+		{options{output: "show-%d.glo"}, []int{0}},
+		{options{output: "show-%d.glo", clubs: 3}, []int{1, 2, 3}},
+		{options{output: "show-%d.glo", club: 2, clubs: 3}, []int{2}},
+	}
+
+	for _, test := range tests {
+		got := test.opts.compiledClubs()
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%+v: got %v, want %v", test.opts, got, test.want)
+		}
+	}
+}
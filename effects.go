@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// chaseCommands expands `CHASE,<clubs>,<color>,<step>,<duration>` and
+// `WAVE,...` for one club.  The clubs take turns in order, each one
+// lighting up for one step, and after the last club it's the first
+// one's turn again.  In a `CHASE` the club switches to the color and
+// back to black, in a `WAVE` it ramps up to the color and back down
+// over two steps, so neighboring clubs overlap.  At the end all clubs
+// are black, including the ones that don't take part and just wait for
+// the duration.
+func chaseCommands(c command, club int, clubs int, groups map[string]clubSelector) []command {
+	step := parseCount(c.fields[3], c.lineNo)
+	duration := parseCount(c.fields[4], c.lineNo)
+
+	selector := parseClubSelector(c.fields[1], groups, c.lineNo)
+	members := selector.members(clubs, c.lineNo)
+	position := -1
+	for i, m := range members {
+		if m == club {
+			position = i
+			break
+		}
+	}
+	if position < 0 {
+		return []command{
+			{fields: []string{"D", strconv.Itoa(duration)}, lineNo: c.lineNo},
+			{fields: []string{"C", "0", "0", "0"}, lineNo: c.lineNo}}
+	}
+
+	var body []command
+	period := len(members) * step
+	if c.fields[0] == "CHASE" {
+		body = []command{
+			{fields: []string{"C", c.fields[2]}, lineNo: c.lineNo},
+			{fields: []string{"D", strconv.Itoa(step)}, lineNo: c.lineNo},
+			{fields: []string{"C", "0", "0", "0"}, lineNo: c.lineNo}}
+		if period > step {
+			body = append(body, command{fields: []string{"D", strconv.Itoa(period - step)}, lineNo: c.lineNo})
+		}
+	} else {
+		if period < 2*step {
+			period = 2 * step
+		}
+		body = []command{
+			{fields: []string{"RAMP", c.fields[2], strconv.Itoa(step)}, lineNo: c.lineNo},
+			{fields: []string{"RAMP", "0", "0", "0", strconv.Itoa(step)}, lineNo: c.lineNo}}
+		if period > 2*step {
+			body = append(body, command{fields: []string{"D", strconv.Itoa(period - 2*step)}, lineNo: c.lineNo})
+		}
+	}
+
+	subCommands := []command{{fields: []string{"C", "0", "0", "0"}, lineNo: c.lineNo}}
+	if position > 0 {
+		subCommands = append(subCommands, command{fields: []string{"D", strconv.Itoa(position * step)}, lineNo: c.lineNo})
+	}
+	subCommands = append(subCommands, command{
+		fields:      []string{"L", strconv.Itoa(duration/period + 1)},
+		lineNo:      c.lineNo,
+		endLine:     "E",
+		subCommands: body})
+
+	return []command{
+		{
+			fields:      []string{"FILL", strconv.Itoa(duration)},
+			lineNo:      c.lineNo,
+			endLine:     "E",
+			subCommands: subCommands},
+		{fields: []string{"C", "0", "0", "0"}, lineNo: c.lineNo}}
+}
+
+// randomCommands expands `RANDOM,<seed>,<colors...>,<step>,<duration>`
+// into a `C` with a randomly picked color for every step.  The random
+// numbers are seeded with the seed and the club, so every club gets a
+// different sequence, but the same one in every compile.
+func randomCommands(c command, club int) []command {
+	seed := parseNumber(c.fields[1], c.lineNo)
+	colors := c.fields[2 : len(c.fields)-2]
+	step := parseCount(c.fields[len(c.fields)-2], c.lineNo)
+	duration := parseCount(c.fields[len(c.fields)-1], c.lineNo)
+
+	random := rand.New(rand.NewSource(int64(seed)*7919 + int64(club)))
+
+	var commands []command
+	for time := 0; time < duration; time += step {
+		length := step
+		if time+length > duration {
+			length = duration - time
+		}
+		commands = append(commands,
+			command{fields: []string{"C", colors[random.Intn(len(colors))]}, lineNo: c.lineNo},
+			command{fields: []string{"D", strconv.Itoa(length)}, lineNo: c.lineNo})
+	}
+	return commands
+}
+
+func (p program) resolveChases(club int, clubs int, groups map[string]clubSelector) program {
+	var newCommands []command
+	for _, c := range p {
+		if c.fields[0] == "CHASE" || c.fields[0] == "WAVE" {
+			if club == 0 {
+				errorExit(c.lineNo, "%s can only be compiled for one club at a time, given with `-club`", c.fields[0])
+			}
+			newCommands = append(newCommands, chaseCommands(c, club, clubs, groups)...)
+			continue
+		}
+		newC := c
+		if c.hasSubCommands() {
+			newC.subCommands = program(c.subCommands).resolveChases(club, clubs, groups)
+		}
+		newCommands = append(newCommands, newC)
+	}
+	return newCommands
+}
+
+func (p program) resolveRandom(club int) program {
+	var newCommands []command
+	for _, c := range p {
+		if c.fields[0] == "RANDOM" {
+			newCommands = append(newCommands, randomCommands(c, club)...)
+			continue
+		}
+		newC := c
+		if c.hasSubCommands() {
+			newC.subCommands = program(c.subCommands).resolveRandom(club)
+		}
+		newCommands = append(newCommands, newC)
+	}
+	return newCommands
+}
+
+const defaultEnvelopeMaxSteps = 50
+
+// envelopeCommands expands `ENVELOPE,<color>,<label>,<resolution>[,<max>]`
+// into a chain of `RAMP`s, one for every `resolution`, whose
+// brightness follows the loudness of the audio during the label.  The
+// loudest step gets the full color.  If that would take more than `max`
+// steps, the steps are made longer.
+func envelopeCommands(c command, labels map[string][]label, a *audio) []command {
+	if len(c.fields) != 4 && len(c.fields) != 5 {
+		errorExit(c.lineNo, "ENVELOPE needs a color, a label, a resolution and optionally a maximum number of steps")
+	}
+	if a == nil {
+		errorExit(c.lineNo, "ENVELOPE needs audio")
+	}
+
+	name, percentage := splitColorDescription(c.fields[1], c.lineNo)
+	l := lookupLabel(labels, c.fields[2], c.lineNo)
+	resolution := parseCount(c.fields[3], c.lineNo)
+	maxSteps := defaultEnvelopeMaxSteps
+	if len(c.fields) == 5 {
+		maxSteps = parseCount(c.fields[4], c.lineNo)
+	}
+
+	duration := l.end - l.start
+	if duration <= 0 {
+		errorExit(c.lineNo, "Label `%s` has no duration", l.name)
+	}
+	if resolution < 0 {
+		errorExit(c.lineNo, "Resolution can't be negative")
+	}
+	steps := (duration + resolution - 1) / resolution
+	if steps > maxSteps {
+		steps = maxSteps
+	}
+
+	levels := make([]float64, steps)
+	loudest := 0.0
+	for i := range levels {
+		levels[i] = a.rms(l.start+i*duration/steps, l.start+(i+1)*duration/steps)
+		loudest = math.Max(loudest, levels[i])
+	}
+
+	var commands []command
+	for i, level := range levels {
+		brightness := 0
+		if loudest > 0 {
+			brightness = int(level / loudest * float64(percentage))
+		}
+		time := (i+1)*duration/steps - i*duration/steps
+		description := name + " " + strconv.Itoa(brightness) + "%"
+		commands = append(commands, command{fields: []string{"RAMP", description, strconv.Itoa(time)}, lineNo: c.lineNo})
+	}
+	return commands
+}
+
+func (p program) resolveEnvelopes(labels map[string][]label, a *audio) program {
+	var newCommands []command
+	for _, c := range p {
+		if c.fields[0] == "ENVELOPE" {
+			newCommands = append(newCommands, envelopeCommands(c, labels, a)...)
+			continue
+		}
+		newC := c
+		if c.hasSubCommands() {
+			newC.subCommands = program(c.subCommands).resolveEnvelopes(labels, a)
+		}
+		newCommands = append(newCommands, newC)
+	}
+	return newCommands
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChaseEndsBlack(t *testing.T) {
+	for _, effect := range []string{"CHASE", "WAVE"} {
+		source := fmt.Sprintf("COLOR,red,255,0,0\nC,0,255,0\n%s,1-3,red,10,65\n", effect)
+		for club := 1; club <= 4; club++ {
+			p, err := compileSource(source, nil, options{clubs: 4}, club)
+			if err != nil {
+				t.Errorf("%s for club %d: %s", effect, club, err.Error())
+				continue
+			}
+			s := simulator{t: t}
+			s.run(p)
+			if len(s.colors) != 65 {
+				t.Errorf("%s for club %d: duration %d, want 65", effect, club, len(s.colors))
+			}
+			if s.color != [3]int{0, 0, 0} {
+				t.Errorf("%s for club %d: ends with %v", effect, club, s.color)
+			}
+		}
+	}
+}
+
+func TestChaseTurns(t *testing.T) {
+	red := command{fields: []string{"COLOR", "red", "255", "0", "0"}, lineNo: 1}
+	c := command{fields: []string{"CHASE", "2 4 6", "red", "10", "60"}, lineNo: 2}
+	var lit []string
+	for club := 1; club <= 6; club++ {
+		s := simulator{t: t}
+		p := append(program{red}, chaseCommands(c, club, 6, nil)...)
+		s.run(p.resolveColor().resolveFill())
+		var turns []string
+		for i, color := range s.colors {
+			if color != "0,0,0" && (i == 0 || s.colors[i-1] != color) {
+				turns = append(turns, fmt.Sprint(i))
+			}
+		}
+		lit = append(lit, fmt.Sprintf("%d:%s", club, strings.Join(turns, ",")))
+	}
+	want := "1: 2:0,30 3: 4:10,40 5: 6:20,50"
+	if strings.Join(lit, " ") != want {
+		t.Errorf("got %s, want %s", strings.Join(lit, " "), want)
+	}
+}
+
+func TestRandomCommands(t *testing.T) {
+	c := command{fields: []string{"RANDOM", "42", "red", "green", "blue", "10", "45"}, lineNo: 7}
+	sequence := func(club int) string {
+		var colors []string
+		for _, rc := range randomCommands(c, club) {
+			colors = append(colors, rc.line())
+		}
+		return strings.Join(colors, " ")
+	}
+
+	first := sequence(1)
+	if again := sequence(1); again != first {
+		t.Errorf("club 1 gets `%s` the first time and `%s` the second", first, again)
+	}
+	if other := sequence(2); other == first {
+		t.Errorf("clubs 1 and 2 both get `%s`", first)
+	}
+
+	for club := 1; club <= 5; club++ {
+		cs := randomCommands(c, club)
+		if len(cs) != 10 {
+			t.Errorf("club %d: %d commands, want 10", club, len(cs))
+			continue
+		}
+		if duration := commandsDuration(cs); duration != 45 {
+			t.Errorf("club %d: duration %d, want 45", club, duration)
+		}
+		if last := cs[len(cs)-1].line(); last != "D,5" {
+			t.Errorf("club %d: ends with `%s`, want `D,5`", club, last)
+		}
+		for i := 0; i < len(cs); i += 2 {
+			if color := cs[i].fields[1]; color != "red" && color != "green" && color != "blue" {
+				t.Errorf("club %d: picks `%s`", club, color)
+			}
+		}
+	}
+
+	_, err := compileSource("RANDOM,42,10,45\n", nil, options{}, 1)
+	if err == nil || !strings.Contains(err.Error(), "RANDOM needs a seed, colors, a step and a duration") {
+		t.Errorf("without colors: got error %v", err)
+	}
+}
+
+func TestEnvelopeCommands(t *testing.T) {
+	samples := make([]float32, 60)
+	for i := range samples {
+		samples[i] = 0.5
+		if i >= 20 && i < 40 {
+			samples[i] = -1
+		}
+	}
+	a := &audio{rate: 100, channels: [][]float32{samples}}
+	labels := map[string][]label{"solo": {{name: "Solo", start: 10, end: 50}}, "cue": {{name: "cue", start: 30, end: 30}}}
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"ENVELOPE,red,solo,10", "RAMP,red 50%,10 RAMP,red 100%,10 RAMP,red 100%,10 RAMP,red 50%,10"},
+		{"ENVELOPE,blue 50%,solo,10", "RAMP,blue 25%,10 RAMP,blue 50%,10 RAMP,blue 50%,10 RAMP,blue 25%,10"},
+		{"ENVELOPE,red,solo,15", "RAMP,red 65%,13 RAMP,red 100%,13 RAMP,red 68%,14"},
+		{"ENVELOPE,red,solo,5,2", "RAMP,red 100%,20 RAMP,red 100%,20"},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, c := range envelopeCommands(command{fields: strings.Split(test.line, ","), lineNo: 1}, labels, a) {
+			got = append(got, c.line())
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%s: got `%s`, want `%s`", test.line, strings.Join(got, " "), test.want)
+		}
+	}
+
+	errors := []struct {
+		line string
+		a    *audio
+		want string
+	}{
+		{"ENVELOPE,red,solo", a, "ENVELOPE needs a color, a label, a resolution"},
+		{"ENVELOPE,red,solo,10", nil, "ENVELOPE needs audio"},
+		{"ENVELOPE,red,cue,10", a, "Label `cue` has no duration"},
+		{"ENVELOPE,red,verse,10", a, "verse"},
+		{"ENVELOPE,red,solo,-10", a, "Resolution can't be negative"},
+	}
+	for _, test := range errors {
+		c := command{fields: strings.Split(test.line, ","), lineNo: 1}
+		err := catchError(func() { envelopeCommands(c, labels, test.a) })
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want `%s`", test.line, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Time expressions are parsed according to this grammar:
+//
+//	expr    = term { ( "+" | "-" ) term }
+//	term    = unary { ( "*" | "/" ) unary }
+//	unary   = "-" unary | "&" label | operand
+//	operand = number
+//	        | "(" expr ")"
+//	        | label [ "." name | "@" percent "%" | ".." label ]
+//	percent = number | "(" expr ")"
+//	label   = ( name | string ) [ "[" expr "]" ]
+//
+// A name is a letter or underscore followed by letters, digits and
+// underscores.  It's either a definition like `club` or the name of a
+// label.  Labels whose names aren't valid names can be given as
+// strings in double quotes, with backslash escaping quotes and
+// backslashes.  Label names are looked up ignoring case.  If there
+// are several labels with the same name, an index picks one of them,
+// counting from 0 in the order they start.
+//
+// `a..b` is the time from the start of label `a` to the start of label
+// `b`, which is mostly useful with point labels.
+
+const exprPunctuation = "+-*/&().@%[]"
+
+type exprToken struct {
+	// kind is 'n' for numbers, 'i' for names, 's' for strings, 'r'
+	// for `..`, 'e' for the end, or the punctuation character.
+	kind   byte
+	text   string
+	column int
+}
+
+type exprNode struct {
+	// kind is 'n' for numbers, 'i' for names, 's' for strings, '.'
+	// for label accessors, '@' for label anchors, 'r' for spans
+	// between labels, or the operator.
+	// Unary operators have one argument, binary ones two.  Labels
+	// have their index as an argument, if they're given one.
+	kind   byte
+	text   string
+	column int
+	args   []*exprNode
+}
+
+// exprError exits with an error at the given column of the
+// expression, counted from 1.
+func exprError(source string, lineNo int, column int, format string, args ...interface{}) {
+	errorExit(lineNo, "In `%s` at column %d: %s", source, column, fmt.Sprintf(format, args...))
+}
+
+func tokenizeExpr(source string, lineNo int) []exprToken {
+	var tokens []exprToken
+	runes := []rune(source)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		column := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '.' && i+1 < len(runes) && runes[i+1] == '.':
+			tokens = append(tokens, exprToken{kind: 'r', text: "..", column: column})
+			i += 2
+		case strings.ContainsRune(exprPunctuation, r):
+			tokens = append(tokens, exprToken{kind: byte(r), text: string(r), column: column})
+			i++
+		case r >= '0' && r <= '9':
+			start := i
+			for i < len(runes) && runes[i] >= '0' && runes[i] <= '9' {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: 'n', text: string(runes[start:i]), column: column})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: 'i', text: string(runes[start:i]), column: column})
+		case r == '"':
+			var text []rune
+			i++
+			for {
+				if i >= len(runes) {
+					exprError(source, lineNo, column, "String is not terminated")
+				}
+				if runes[i] == '"' {
+					break
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				text = append(text, runes[i])
+				i++
+			}
+			i++
+			tokens = append(tokens, exprToken{kind: 's', text: string(text), column: column})
+		default:
+			exprError(source, lineNo, column, "Unexpected character `%c`", r)
+		}
+	}
+	return append(tokens, exprToken{kind: 'e', column: len(runes) + 1})
+}
+
+type exprParser struct {
+	source string
+	lineNo int
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) fail(expected string) {
+	t := p.tokens[p.pos]
+	if t.kind == 'e' {
+		exprError(p.source, p.lineNo, t.column, "Expected %s at the end", expected)
+	}
+	exprError(p.source, p.lineNo, t.column, "Expected %s but got `%s`", expected, t.text)
+}
+
+func (p *exprParser) peek(kind byte) bool {
+	return p.tokens[p.pos].kind == kind
+}
+
+func (p *exprParser) accept(kind byte) bool {
+	if p.peek(kind) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(kind byte, expected string) exprToken {
+	if !p.peek(kind) {
+		p.fail(expected)
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *exprParser) parseExpr() *exprNode {
+	n := p.parseTerm()
+	for p.peek('+') || p.peek('-') {
+		op := p.tokens[p.pos]
+		p.pos++
+		n = &exprNode{kind: op.kind, text: op.text, column: op.column, args: []*exprNode{n, p.parseTerm()}}
+	}
+	return n
+}
+
+func (p *exprParser) parseTerm() *exprNode {
+	n := p.parseUnary()
+	for p.peek('*') || p.peek('/') {
+		op := p.tokens[p.pos]
+		p.pos++
+		n = &exprNode{kind: op.kind, text: op.text, column: op.column, args: []*exprNode{n, p.parseUnary()}}
+	}
+	return n
+}
+
+func (p *exprParser) parseUnary() *exprNode {
+	op := p.tokens[p.pos]
+	if p.accept('-') {
+		return &exprNode{kind: '-', text: op.text, column: op.column, args: []*exprNode{p.parseUnary()}}
+	}
+	if p.accept('&') {
+		return &exprNode{kind: '&', text: op.text, column: op.column, args: []*exprNode{p.parseLabel()}}
+	}
+	return p.parseOperand()
+}
+
+func (p *exprParser) parseLabel() *exprNode {
+	t := p.tokens[p.pos]
+	if !p.accept('i') && !p.accept('s') {
+		p.fail("a label")
+	}
+	n := &exprNode{kind: t.kind, text: t.text, column: t.column}
+	if p.accept('[') {
+		n.args = []*exprNode{p.parseExpr()}
+		p.expect(']', "`]`")
+	}
+	return n
+}
+
+func (p *exprParser) parseOperand() *exprNode {
+	t := p.tokens[p.pos]
+	if p.accept('n') {
+		return &exprNode{kind: 'n', text: t.text, column: t.column}
+	}
+	if p.accept('(') {
+		n := p.parseExpr()
+		p.expect(')', "`)`")
+		return n
+	}
+	if !p.peek('i') && !p.peek('s') {
+		p.fail("a number, a label or `(`")
+	}
+
+	l := p.parseLabel()
+	if p.accept('.') {
+		accessor := p.expect('i', "`start`, `end`, `mid` or `len`")
+		return &exprNode{kind: '.', text: accessor.text, column: accessor.column, args: []*exprNode{l}}
+	}
+	if p.accept('@') {
+		var percent *exprNode
+		t := p.tokens[p.pos]
+		if p.accept('n') {
+			percent = &exprNode{kind: 'n', text: t.text, column: t.column}
+		} else if p.accept('(') {
+			percent = p.parseExpr()
+			p.expect(')', "`)`")
+		} else {
+			p.fail("a percentage")
+		}
+		p.expect('%', "`%`")
+		return &exprNode{kind: '@', column: t.column, args: []*exprNode{l, percent}}
+	}
+	if p.accept('r') {
+		return &exprNode{kind: 'r', text: "..", column: l.column, args: []*exprNode{l, p.parseLabel()}}
+	}
+	return l
+}
+
+func parseExpr(source string, lineNo int) *exprNode {
+	p := exprParser{source: source, lineNo: lineNo, tokens: tokenizeExpr(source, lineNo)}
+	n := p.parseExpr()
+	if !p.peek('e') {
+		p.fail("an operator")
+	}
+	return n
+}
+
+type exprEnv struct {
+	source      string
+	lineNo      int
+	labels      map[string][]label
+	definitions map[string]int
+}
+
+func (env *exprEnv) fail(n *exprNode, format string, args ...interface{}) {
+	exprError(env.source, env.lineNo, n.column, format, args...)
+}
+
+// label returns the label a node refers to, if it does.  That's a name
+// that's not a definition, or a string.
+func (env *exprEnv) label(n *exprNode) (label, bool) {
+	if n.kind == 'i' {
+		if _, isDefinition := env.definitions[n.text]; isDefinition {
+			if len(n.args) > 0 {
+				env.fail(n, "`%s` is not a label", n.text)
+			}
+			return label{}, false
+		}
+		if n.text == "club" || n.text == "clubs" {
+			env.fail(n, "`%s` is only defined when given with `-%s`", n.text, n.text)
+		}
+	} else if n.kind != 's' {
+		return label{}, false
+	}
+	index := -1
+	if len(n.args) > 0 {
+		index = env.eval(n.args[0])
+		if index < 0 {
+			env.fail(n.args[0], "Label index can't be negative")
+		}
+	}
+	l, err := occurrence(env.labels[strings.ToLower(n.text)], n.text, index)
+	if err != nil {
+		env.fail(n, "%s", err.Error())
+	}
+	return l, true
+}
+
+func (env *exprEnv) mustLabel(n *exprNode) label {
+	l, ok := env.label(n)
+	if !ok {
+		env.fail(n, "`%s` is not a label", n.text)
+	}
+	return l
+}
+
+// labelAccessor returns the time stamp that `label.accessor` stands
+// for.
+func (env *exprEnv) labelAccessor(l label, n *exprNode) int {
+	switch strings.ToLower(n.text) {
+	case "start":
+		return l.start
+	case "end":
+		return l.end
+	case "mid":
+		return (l.start + l.end) / 2
+	case "len":
+		return env.labelLength(l, n)
+	}
+	env.fail(n, "Unknown label accessor `%s`", n.text)
+	return -1
+}
+
+func (env *exprEnv) labelLength(l label, n *exprNode) int {
+	if l.start == l.end {
+		env.fail(n, "`%s` is a point label and has no length", l.name)
+	}
+	return l.end - l.start
+}
+
+func (env *exprEnv) eval(n *exprNode) int {
+	switch n.kind {
+	case 'n':
+		number, err := strconv.Atoi(n.text)
+		if err != nil {
+			env.fail(n, "Number `%s` is too large", n.text)
+		}
+		return number
+	case 'i', 's':
+		if l, ok := env.label(n); ok {
+			return l.start
+		}
+		return env.definitions[n.text]
+	case '.':
+		return env.labelAccessor(env.mustLabel(n.args[0]), n)
+	case '@':
+		l := env.mustLabel(n.args[0])
+		return l.start + (l.end-l.start)*env.eval(n.args[1])/100
+	case '&':
+		return env.labelLength(env.mustLabel(n.args[0]), n.args[0])
+	case 'r':
+		from := env.mustLabel(n.args[0])
+		to := env.mustLabel(n.args[1])
+		if to.start < from.start {
+			env.fail(n, "`%s` starts before `%s`", to.name, from.name)
+		}
+		return to.start - from.start
+	}
+
+	if len(n.args) == 1 {
+		// A minus before a label stands for its end.
+		if l, ok := env.label(n.args[0]); ok {
+			return l.end
+		}
+		return -env.eval(n.args[0])
+	}
+
+	left := env.eval(n.args[0])
+	right := env.eval(n.args[1])
+	switch n.kind {
+	case '/':
+		if right == 0 {
+			env.fail(n, "Division by zero")
+		}
+		return left / right
+	case '*':
+		return left * right
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	}
+	panic(fmt.Sprintf("unexpected expression node %c", n.kind))
+}
+
+func evalExpr(s string, labels map[string][]label, definitions map[string]int, lineNo int) int {
+	env := exprEnv{source: s, lineNo: lineNo, labels: labels, definitions: definitions}
+	return env.eval(parseExpr(s, lineNo))
+}
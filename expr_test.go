@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var exprLabels = map[string][]label{
+	"verse":  {{name: "Verse", start: 100, end: 300}},
+	"chorus": {{name: "chorus", start: 400, end: 480}},
+	"drop":   {{name: "drop", start: 350, end: 350}},
+
+	"guitar solo (live)": {{name: "Guitar Solo (live)", start: 500, end: 700}},
+	`say "hi"\now`:       {{name: `say "hi"\now`, start: 800, end: 900}},
+}
+
+func evalTestExpr(source string) (result int, err error) {
+	err = catchError(func() {
+		result = evalExpr(source, exprLabels, map[string]int{"club": 3, "n": 2}, 4)
+	})
+	return result, err
+}
+
+func TestLabelAccessors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int
+	}{
+		{"verse", 100},
+		{"VERSE.start", 100},
+		{"verse.end", 300},
+		{"verse.mid", 200},
+		{"verse.LEN", 200},
+		{"&verse", 200},
+		{"-verse", 300},
+		{"verse@25%", 150},
+		{"verse@(club*10)%", 160},
+		{"verse@100% - 5", 295},
+		{"chorus.end - verse.start", 380},
+		{"verse..chorus", 300},
+		{"drop", 350},
+		{"drop.mid", 350},
+	}
+
+	for _, test := range tests {
+		got, err := evalTestExpr(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err.Error())
+		} else if got != test.want {
+			t.Errorf("%s: got %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestLabelAccessorErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"verse.length", "at column 7: Unknown label accessor `length`"},
+		{"verse@25", "at column 9: Expected `%` at the end"},
+		{"verse@%", "at column 7: Expected a percentage but got `%`"},
+		{"drop.len", "at column 6: `drop` is a point label and has no length"},
+		{"&drop", "at column 2: `drop` is a point label and has no length"},
+		{"chorus..verse", "at column 1: `Verse` starts before `chorus`"},
+		{"club.start", "at column 1: `club` is not a label"},
+		{"bridge.end", "at column 1: Unknown label `bridge`"},
+		{"&7", "at column 2: Expected a label but got `7`"},
+	}
+
+	for _, test := range tests {
+		_, err := evalTestExpr(test.expr)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want `%s`", test.expr, err, test.want)
+		}
+	}
+}
+
+func TestTokenizeExpr(t *testing.T) {
+	var got []string
+	for _, token := range tokenizeExpr(`a_1+ 23*"x \"y\""..b.end@(5)%`, 0) {
+		got = append(got, fmt.Sprintf("%c%d[%s]", token.kind, token.column, token.text))
+	}
+	want := `i1[a_1] +4[+] n6[23] *8[*] s9[x "y"] r18[..] i20[b] .21[.] i22[end] @25[@] (26[(] n27[5] )28[)] %29[%] e30[]`
+	if strings.Join(got, " ") != want {
+		t.Errorf("got  %s\nwant %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestExprGrammar(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int
+	}{
+		{"1+2*3", 7},
+		{"(1+2)*3", 9},
+		{"10-4-3", 3},
+		{"100/7/2", 7},
+		{"--5", 5},
+		{"-(2+3)*n", -10},
+		{"  club  *  10 ", 30},
+		{`"Guitar Solo (live)"`, 500},
+		{`"guitar solo (live)".end - "GUITAR SOLO (LIVE)"@50%`, 100},
+		{`-"guitar solo (live)"`, 700},
+		{`&"say \"hi\"\\now"`, 100},
+		{`verse.."guitar solo (live)"`, 400},
+	}
+
+	for _, test := range tests {
+		got, err := evalTestExpr(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err.Error())
+		} else if got != test.want {
+			t.Errorf("%s: got %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestExprGrammarErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "at column 1: Expected a number, a label or `(` at the end"},
+		{"1+", "at column 3: Expected a number, a label or `(` at the end"},
+		{"(1+2", "at column 5: Expected `)` at the end"},
+		{"1 2", "at column 3: Expected an operator but got `2`"},
+		{"verse chorus", "at column 7: Expected an operator but got `chorus`"},
+		{"3 # 4", "at column 3: Unexpected character `#`"},
+		{`"guitar solo`, "at column 1: String is not terminated"},
+		{"1/(n-2)", "at column 2: Division by zero"},
+		{"99999999999999999999", "at column 1: Number `99999999999999999999` is too large"},
+		{`"Guitar Solo"`, "at column 1: Unknown label `Guitar Solo`"},
+	}
+
+	for _, test := range tests {
+		_, err := evalTestExpr(test.expr)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want `%s`", test.expr, err, test.want)
+		}
+	}
+}
+
+func TestRepeatedLabels(t *testing.T) {
+	labels := mapFromLabels([]label{
+		{name: "Hit", start: 40, end: 40},
+		{name: "verse", start: 100, end: 300},
+		{name: "hit", start: 10, end: 10},
+		{name: "HIT", start: 20, end: 25},
+	})
+	if len(labels["hit"]) != 3 {
+		t.Fatalf("got %d labels `hit`, want 3", len(labels["hit"]))
+	}
+
+	tests := []struct {
+		expr string
+		want int
+	}{
+		{"hit[0]", 10},
+		{"Hit[2]", 40},
+		{"hit[n-1].end", 25},
+		{"hit[0]..hit[2]", 30},
+		{"verse[0]", 100},
+		{"verse", 100},
+	}
+	for _, test := range tests {
+		got := evalExpr(test.expr, labels, map[string]int{"n": 2}, 0)
+		if got != test.want {
+			t.Errorf("%s: got %d, want %d", test.expr, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		expr string
+		want string
+	}{
+		{"hit", "Label `hit` occurs 3 times, so it needs an index from `hit[0]` to `hit[2]`"},
+		{"hit[3]", "Label `hit` only occurs 3 times"},
+		{"hit[0-1]", "Label index can't be negative"},
+		{"n[0]", "`n` is not a label"},
+		{"hit[0", "Expected `]` at the end"},
+	}
+	for _, test := range errors {
+		err := catchError(func() { evalExpr(test.expr, labels, map[string]int{"n": 2}, 0) })
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want `%s`", test.expr, err, test.want)
+		}
+	}
+
+	for name, want := range map[string]int{"hit[1]": 20, "HIT [ 2 ]": 40, "verse": 100} {
+		if got := lookupLabel(labels, name, 0); got.start != want {
+			t.Errorf("looking up `%s`: got %v, want start %d", name, got, want)
+		}
+	}
+	if err := catchError(func() { lookupLabel(labels, "hit", 0) }); err == nil || !strings.Contains(err.Error(), "needs an index") {
+		t.Errorf("looking up `hit`: got error %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type jsonCommand struct {
+	Fields []string `json:"fields"`
+	// Line is the input line the command came from, counting from 1,
+	// or 0 if the compiler made it up.
+	Line int `json:"line"`
+	// Label is the label the command was generated for in timeline
+	// mode.
+	Label string `json:"label,omitempty"`
+	// Start is the absolute time at which the command starts.  For
+	// commands in loops it's the start in the first iteration.  A
+	// `CLUBS` block doesn't move the start of the commands after it.
+	Start       int           `json:"start"`
+	Duration    int           `json:"duration"`
+	SubCommands []jsonCommand `json:"subCommands,omitempty"`
+}
+
+type jsonProgram struct {
+	// Club is zero if the program isn't specialized for a club.
+	Club int `json:"club"`
+	// Duration is the time at which the last command ends.
+	Duration int           `json:"duration"`
+	Commands []jsonCommand `json:"commands"`
+}
+
+func jsonCommands(cs []command, start int) []jsonCommand {
+	commands := []jsonCommand{}
+	time := start
+	for _, c := range cs {
+		if c.isEmptyLine() {
+			continue
+		}
+		jc := jsonCommand{Fields: c.fields, Line: c.lineNo + 1, Label: c.label, Start: time, Duration: c.duration()}
+		if c.hasSubCommands() {
+			jc.SubCommands = jsonCommands(c.subCommands, time)
+		}
+		commands = append(commands, jc)
+		time += c.sharedDuration()
+	}
+	return commands
+}
+
+// writeJSON writes the program as JSON, for tools that would rather not
+// parse glo.
+func (p program) writeJSON(w io.Writer, club int) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	commands := jsonCommands(p, 0)
+	duration := 0
+	for _, jc := range commands {
+		duration = maxInt(duration, jc.Start+jc.Duration)
+	}
+	return encoder.Encode(jsonProgram{Club: club, Duration: duration, Commands: commands})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// flatten lists the commands of a JSON program with their line, start
+// and duration, with blocks followed by their commands.
+func flatten(commands []jsonCommand) []string {
+	var lines []string
+	for _, jc := range commands {
+		text := fmt.Sprintf("%s@%d:%d+%d", strings.Join(jc.Fields, ","), jc.Line, jc.Start, jc.Duration)
+		if jc.Label != "" {
+			text += " " + jc.Label
+		}
+		lines = append(lines, text)
+		lines = append(lines, flatten(jc.SubCommands)...)
+	}
+	return lines
+}
+
+func TestWriteJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		club     int
+		duration int
+		want     string
+	}{
+		{
+			name:     "loop",
+			source:   "C,255,0,0\n\nL,3\n\tD,5\n\tRAMP,0,0,255,10\nE\n",
+			club:     2,
+			duration: 45,
+			want:     "C,255,0,0@1:0+0|L,3@3:0+45|D,5@4:0+5|RAMP,0,0,255,10@5:5+10",
+		},
+		{
+			name:     "clubs without club",
+			source:   "CLUBS,1\n\tD,30\nE\nD,5\nTIME,20\nC,0,0,0\n",
+			duration: 30,
+			want:     "CLUBS,1@1:0+30|D,30@2:0+30|D,5@4:0+5|D,15@5:5+15|C,0,0,0@6:20+0",
+		},
+	}
+
+	for _, test := range tests {
+		p, err := compileSource(test.source, nil, options{clubs: 2}, test.club)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		var b strings.Builder
+		if err := p.writeJSON(&b, test.club); err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded jsonProgram
+		if err := json.Unmarshal([]byte(b.String()), &decoded); err != nil {
+			t.Errorf("%s: %s in\n%s", test.name, err.Error(), b.String())
+			continue
+		}
+		if decoded.Club != test.club || decoded.Duration != test.duration {
+			t.Errorf("%s: club %d with duration %d, want club %d with duration %d", test.name, decoded.Club, decoded.Duration, test.club, test.duration)
+		}
+		if got := strings.Join(flatten(decoded.Commands), "|"); got != test.want {
+			t.Errorf("%s: got  %s\nwant %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWriteJSONGenerated(t *testing.T) {
+	labels := []label{{name: "red", start: 100, end: 150}}
+	p, err := compileSource("COLOR,red,255,0,0\n", labels, options{timeline: true, optimize: true}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var b strings.Builder
+	p.writeJSON(&b, 0)
+
+	var decoded jsonProgram
+	if err := json.Unmarshal([]byte(b.String()), &decoded); err != nil {
+		t.Fatal(err.Error())
+	}
+	got := strings.Join(flatten(decoded.Commands), "|")
+	want := "C,0,0,0@0:0+0|D,100@0:0+100 red|C,255,0,0@0:100+0 red|D,50@0:100+50 red|C,0,0,0@0:150+0 red|END@0:150+0"
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if strings.Contains(b.String(), `"subCommands"`) {
+		t.Errorf("commands without blocks have subCommands:\n%s", b.String())
+	}
+}
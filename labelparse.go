@@ -0,0 +1,209 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Label titles in timeline mode are parsed according to this grammar:
+//
+//	title    = [ clubs ":" ] sequence
+//	clubs    = "C" word { "," word }
+//	sequence = element { ">" element }
+//	element  = "RAMP" ":" word { ":" word }
+//	         | "FADEIN" ":" word
+//	         | "FADEOUT"
+//	         | word "(" word { "," word } ")"
+//	         | word { "/" word } [ "*" word ]
+//
+// A word is any text that doesn't contain one of the punctuation
+// characters `:>/*(),`, with surrounding whitespace removed, so color
+// descriptions like `red 50%` and ramp positions like `red@30%` are
+// single words.
+
+const labelPunctuation = ":>/*(),"
+
+type labelToken struct {
+	// kind is 'w' for words, or the punctuation character.
+	kind byte
+	text string
+}
+
+type labelElement struct {
+	// kind is "name", "ramp", "fadein", "fadeout", or the name of a
+	// function like "strobe".
+	kind  string
+	args  []string
+	count int
+}
+
+type labelSpec struct {
+	clubs    []string
+	elements []labelElement
+}
+
+var labelClubsRegexp = regexp.MustCompile("^[cC]\\s*(\\S.*)$")
+
+func tokenizeLabel(title string) []labelToken {
+	var tokens []labelToken
+	word := ""
+	flush := func() {
+		word = strings.TrimSpace(word)
+		if word != "" {
+			tokens = append(tokens, labelToken{kind: 'w', text: word})
+		}
+		word = ""
+	}
+	for _, r := range title {
+		if strings.ContainsRune(labelPunctuation, r) {
+			flush()
+			tokens = append(tokens, labelToken{kind: byte(r), text: string(r)})
+			continue
+		}
+		word += string(r)
+	}
+	flush()
+	return tokens
+}
+
+type labelParser struct {
+	title  string
+	tokens []labelToken
+	pos    int
+}
+
+func (p *labelParser) fail(expected string) {
+	if p.pos < len(p.tokens) {
+		errorExit(-1, "Incorrect label `%s`: expected %s but got `%s`", p.title, expected, p.tokens[p.pos].text)
+	}
+	errorExit(-1, "Incorrect label `%s`: expected %s at the end", p.title, expected)
+}
+
+func (p *labelParser) peek(kind byte) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == kind
+}
+
+func (p *labelParser) accept(kind byte) bool {
+	if p.peek(kind) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *labelParser) expect(kind byte, expected string) string {
+	if !p.peek(kind) {
+		p.fail(expected)
+	}
+	p.pos++
+	return p.tokens[p.pos-1].text
+}
+
+func isLabelKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case "ramp", "fadein", "fadeout", "hold":
+		return true
+	}
+	return false
+}
+
+// parseClubs parses the optional club prefix.  It's only a prefix if
+// a colon follows, since no other element is a word followed by a
+// colon.
+func (p *labelParser) parseClubs() []string {
+	if !p.peek('w') || isLabelKeyword(p.tokens[p.pos].text) {
+		return nil
+	}
+	end := p.pos + 1
+	for end+1 < len(p.tokens) && p.tokens[end].kind == ',' && p.tokens[end+1].kind == 'w' {
+		end += 2
+	}
+	if end >= len(p.tokens) || p.tokens[end].kind != ':' {
+		return nil
+	}
+
+	matches := labelClubsRegexp.FindStringSubmatch(p.tokens[p.pos].text)
+	if matches == nil {
+		p.fail("clubs")
+	}
+	clubs := []string{matches[1]}
+	for i := p.pos + 2; i < end; i += 2 {
+		clubs = append(clubs, p.tokens[i].text)
+	}
+	p.pos = end + 1
+	return clubs
+}
+
+func (p *labelParser) parseElement() labelElement {
+	word := p.expect('w', "a color, sub or effect")
+	switch strings.ToLower(word) {
+	case "ramp":
+		element := labelElement{kind: "ramp"}
+		for p.accept(':') {
+			element.args = append(element.args, p.expect('w', "a color"))
+		}
+		return element
+	case "fadein":
+		p.expect(':', "`:`")
+		return labelElement{kind: "fadein", args: []string{p.expect('w', "a color")}}
+	case "fadeout":
+		return labelElement{kind: "fadeout"}
+	}
+
+	if p.accept('(') {
+		element := labelElement{kind: strings.ToLower(word)}
+		element.args = append(element.args, p.expect('w', "an argument"))
+		for p.accept(',') {
+			element.args = append(element.args, p.expect('w', "an argument"))
+		}
+		p.expect(')', "`)`")
+		return element
+	}
+
+	element := labelElement{kind: "name", args: []string{word}, count: 1}
+	for p.accept('/') {
+		element.args = append(element.args, p.expect('w', "a color"))
+	}
+	if p.accept('*') {
+		count, err := strconv.Atoi(p.expect('w', "a count"))
+		if err != nil || count <= 0 {
+			p.pos--
+			p.fail("a positive count")
+		}
+		element.count = count
+	}
+	return element
+}
+
+func parseLabelTitle(title string) labelSpec {
+	p := labelParser{title: title, tokens: tokenizeLabel(title)}
+	spec := labelSpec{clubs: p.parseClubs()}
+	spec.elements = append(spec.elements, p.parseElement())
+	for p.accept('>') {
+		spec.elements = append(spec.elements, p.parseElement())
+	}
+	if p.pos < len(p.tokens) {
+		p.fail("`>`")
+	}
+	return spec
+}
+
+// clubsKey is the club prefix of a label, in a form that's the same for
+// labels with the same prefix.
+func (spec labelSpec) clubsKey() string {
+	return strings.ToLower(strings.Join(spec.clubs, ","))
+}
+
+// isSingleColor is whether the label is nothing but a color.
+func (spec labelSpec) isSingleColor(colors map[string]color) bool {
+	if len(spec.elements) != 1 {
+		return false
+	}
+	e := spec.elements[0]
+	if e.kind != "name" || len(e.args) != 1 || e.count > 1 {
+		return false
+	}
+	ok, _, _ := lookupColor(colors, e.args[0])
+	return ok
+}
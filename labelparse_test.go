@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// String shows an element in the same form as the label it came from.
+func (e labelElement) String() string {
+	switch {
+	case e.kind == "name" && e.count > 1:
+		return fmt.Sprintf("%s*%d", strings.Join(e.args, "/"), e.count)
+	case e.kind == "name":
+		return strings.Join(e.args, "/")
+	}
+	return fmt.Sprintf("%s(%s)", e.kind, strings.Join(e.args, ","))
+}
+
+func TestTokenizeLabel(t *testing.T) {
+	var got []string
+	for _, token := range tokenizeLabel(" C1-3 , 5 :red 50% / blue*2>strobe( white,20 )") {
+		got = append(got, fmt.Sprintf("%c[%s]", token.kind, token.text))
+	}
+	want := "w[C1-3] ,[,] w[5] :[:] w[red 50%] /[/] w[blue] *[*] w[2] >[>] w[strobe] ([(] w[white] ,[,] w[20] )[)]"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got  %s\nwant %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestParseLabelTitle(t *testing.T) {
+	tests := []struct {
+		title    string
+		clubs    string
+		elements string
+	}{
+		{"red", "", "[red]"},
+		{"red 50%", "", "[red 50%]"},
+		{"C1,3,5:RAMP:black:white:black", "1,3,5", "[ramp(black,white,black)]"},
+		{"Cleft:white", "left", "[white]"},
+		{"c2-4 except 3:red/white*8", "2-4 except 3", "[red/white*8]"},
+		{"FADEIN:red > strobe(white,20,5) > FADEOUT", "", "[fadein(red) strobe(white,20,5) fadeout()]"},
+		{"ramp:black:red@30%:HOLD:white", "", "[ramp(black,red@30%,HOLD,white)]"},
+		{"verse", "", "[verse]"},
+	}
+
+	for _, test := range tests {
+		spec := parseLabelTitle(test.title)
+		if clubs := strings.Join(spec.clubs, ","); clubs != test.clubs {
+			t.Errorf("%s: got clubs `%s`, want `%s`", test.title, clubs, test.clubs)
+		}
+		if elements := fmt.Sprint(spec.elements); elements != test.elements {
+			t.Errorf("%s: got %s, want %s", test.title, elements, test.elements)
+		}
+	}
+}
+
+func TestParseLabelTitleErrors(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"", "expected a color, sub or effect at the end"},
+		{"red >", "expected a color, sub or effect at the end"},
+		{"RAMP:black:", "expected a color at the end"},
+		{"red/white*0", "expected a positive count but got `0`"},
+		{"red*two", "expected a positive count but got `two`"},
+		{"strobe(white", "expected `)` at the end"},
+		{"FADEIN > red", "expected `:` but got `>`"},
+		{"red)", "expected `>` but got `)`"},
+		{"X1:red", "expected clubs but got `X1`"},
+	}
+
+	for _, test := range tests {
+		err := catchError(func() { parseLabelTitle(test.title) })
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("`%s`: got error %v, want `%s`", test.title, err, test.want)
+		}
+	}
+}
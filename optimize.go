@@ -0,0 +1,239 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The longest sequence of commands that we try to fold into a loop.
+// Longer ones are rare and would make the search slow.
+const maxRepeatLength = 64
+
+func commandsEqual(a []command, b []command) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.Join(a[i].fields, ",") != strings.Join(b[i].fields, ",") {
+			return false
+		}
+		if !commandsEqual(a[i].subCommands, b[i].subCommands) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeDelays merges consecutive `D`s and drops `C`s that set the
+// color the club already has.  Empty lines and comments are kept, but
+// don't keep `D`s apart.
+func mergeDelays(cs []command) []command {
+	var newCommands []command
+	lastDelay := -1
+	currentColor := ""
+	for _, c := range cs {
+		switch {
+		case c.isEmptyLine():
+			newCommands = append(newCommands, c)
+			continue
+		case c.fields[0] == "D" && lastDelay >= 0:
+			d := &newCommands[lastDelay]
+			sum := parseCount(d.fields[1], d.lineNo) + parseCount(c.fields[1], c.lineNo)
+			d.setFields([]string{"D", strconv.Itoa(sum)})
+			continue
+		case c.fields[0] == "C" && len(c.fields) == 4:
+			color := strings.Join(c.fields[1:4], ",")
+			if color == currentColor {
+				continue
+			}
+			currentColor = color
+		case c.fields[0] == "RAMP" && len(c.fields) == 5:
+			currentColor = strings.Join(c.fields[1:4], ",")
+		case c.fields[0] == "D":
+		default:
+			currentColor = ""
+		}
+
+		lastDelay = -1
+		if c.fields[0] == "D" {
+			lastDelay = len(newCommands)
+		}
+		newCommands = append(newCommands, c)
+	}
+	return newCommands
+}
+
+// mergeLoops merges a loop with an immediately following loop with the
+// same body, or with a following copy of its body, as long as the loop
+// doesn't get more than maxCount iterations, if that isn't zero.
+func mergeLoops(cs []command, maxCount int) []command {
+	var newCommands []command
+	i := 0
+	for i < len(cs) {
+		c := cs[i]
+		i++
+		if c.fields[0] != "L" {
+			newCommands = append(newCommands, c)
+			continue
+		}
+
+		count := parseCount(c.fields[1], c.lineNo)
+		fits := func(more int) bool {
+			return maxCount <= 0 || count+more <= maxCount
+		}
+		for i < len(cs) {
+			next := cs[i]
+			if next.fields[0] == "L" && commandsEqual(c.subCommands, next.subCommands) && fits(parseCount(next.fields[1], next.lineNo)) {
+				count += parseCount(next.fields[1], next.lineNo)
+				i++
+			} else if len(c.subCommands) > 0 && i+len(c.subCommands) <= len(cs) && commandsEqual(c.subCommands, cs[i:i+len(c.subCommands)]) && fits(1) {
+				count++
+				i += len(c.subCommands)
+			} else {
+				break
+			}
+		}
+		if count != parseCount(c.fields[1], c.lineNo) {
+			c.setFields([]string{"L", strconv.Itoa(count)})
+		}
+		newCommands = append(newCommands, c)
+	}
+	return newCommands
+}
+
+// compressRepeats folds sequences of commands that repeat into loops,
+// picking at each position the repetition that saves the most
+// commands.  level is how deeply nested cs already is.  Loops are kept
+// within the depth and iteration limits, so longer runs are split into
+// several loops.
+func compressRepeats(cs []command, level int, limits sizeLimits) []command {
+	var newCommands []command
+	i := 0
+	for i < len(cs) {
+		bestSaving := 0
+		bestLength := 0
+		bestCount := 0
+		for length := 1; length <= maxRepeatLength && i+2*length <= len(cs); length++ {
+			body := cs[i : i+length]
+			count := 1
+			for (limits.loopCount <= 0 || count < limits.loopCount) && i+(count+1)*length <= len(cs) && commandsEqual(body, cs[i+count*length:i+(count+1)*length]) {
+				count++
+			}
+			if count < 2 {
+				continue
+			}
+			if limits.depth > 0 && level+program(body).depth()+1 > limits.depth {
+				continue
+			}
+
+			size := program(body).commandCount()
+			saving := size*count - (size + 2)
+			if saving > bestSaving {
+				bestSaving = saving
+				bestLength = length
+				bestCount = count
+			}
+		}
+
+		if bestSaving == 0 {
+			newCommands = append(newCommands, cs[i])
+			i++
+			continue
+		}
+
+		body := make([]command, bestLength)
+		copy(body, cs[i:i+bestLength])
+		newCommands = append(newCommands, command{
+			fields:      []string{"L", strconv.Itoa(bestCount)},
+			lineNo:      cs[i].lineNo,
+			label:       cs[i].label,
+			endLine:     "E",
+			subCommands: compressRepeats(body, level+1, limits)})
+		i += bestLength * bestCount
+	}
+	return newCommands
+}
+
+// compressLoops compresses runs of commands between empty lines and
+// comments, which we don't want to lose.
+func compressLoops(cs []command, level int, limits sizeLimits) []command {
+	var newCommands []command
+	start := 0
+	for i := 0; i <= len(cs); i++ {
+		if i < len(cs) && !cs[i].isEmptyLine() {
+			continue
+		}
+		newCommands = append(newCommands, mergeLoops(compressRepeats(cs[start:i], level, limits), limits.loopCount)...)
+		if i < len(cs) {
+			newCommands = append(newCommands, cs[i])
+		}
+		start = i + 1
+	}
+	return newCommands
+}
+
+func optimizeCommands(cs []command, level int, limits sizeLimits) []command {
+	var newCommands []command
+	for _, c := range cs {
+		newC := c
+		if c.hasSubCommands() {
+			newC.subCommands = optimizeCommands(c.subCommands, level+1, limits)
+		}
+		newCommands = append(newCommands, newC)
+	}
+	return mergeDelays(compressLoops(mergeDelays(newCommands), level, limits))
+}
+
+func isEmptyBlock(c command) bool {
+	if c.fields[0] != "L" && c.fields[0] != "CLUBS" {
+		return false
+	}
+	for _, sc := range c.subCommands {
+		if !sc.isEmptyLine() {
+			return false
+		}
+	}
+	return true
+}
+
+func peepholeCommands(cs []command) []command {
+	var newCommands []command
+	for _, c := range cs {
+		if c.hasSubCommands() {
+			c.subCommands = peepholeCommands(c.subCommands)
+			if isEmptyBlock(c) {
+				continue
+			}
+		}
+
+		// A color that's set and immediately replaced by another one
+		// is never seen.  A `RAMP` does need the color it starts from,
+		// though.
+		if c.fields[0] == "C" {
+			previous := len(newCommands) - 1
+			for previous >= 0 && newCommands[previous].isEmptyLine() {
+				previous--
+			}
+			if previous >= 0 && newCommands[previous].fields[0] == "C" {
+				newCommands = append(newCommands[0:previous], newCommands[previous+1:len(newCommands)]...)
+			}
+		}
+
+		newCommands = append(newCommands, c)
+	}
+	return mergeDelays(newCommands)
+}
+
+// peephole removes colors that are overridden without time passing,
+// merges consecutive `D`s and drops empty blocks.
+func (p program) peephole() program {
+	return peepholeCommands(p)
+}
+
+// optimize makes the program smaller without changing what the clubs
+// do, by merging delays, dropping redundant colors, and folding
+// repeated commands into loops that stay within the depth and
+// iteration limits.
+func (p program) optimize(limits sizeLimits) program {
+	return optimizeCommands(p, 0, limits)
+}
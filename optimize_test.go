@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// simulator runs a program the way a club does, recording its color in
+// every time step.
+type simulator struct {
+	t      *testing.T
+	color  [3]int
+	colors []string
+}
+
+func (s *simulator) colorFields(fields []string) [3]int {
+	var c [3]int
+	for i := range c {
+		c[i] = parseNumber(fields[i], noLine)
+	}
+	return c
+}
+
+func (s *simulator) wait(duration int) {
+	for i := 0; i < duration; i++ {
+		s.colors = append(s.colors, fmt.Sprintf("%d,%d,%d", s.color[0], s.color[1], s.color[2]))
+	}
+}
+
+func (s *simulator) run(cs []command) {
+	for _, c := range cs {
+		switch {
+		case c.isEmptyLine() || c.fields[0] == "END":
+		case c.fields[0] == "C" && len(c.fields) == 4:
+			s.color = s.colorFields(c.fields[1:4])
+		case c.fields[0] == "D":
+			s.wait(parseCount(c.fields[1], c.lineNo))
+		case c.fields[0] == "RAMP" && len(c.fields) == 5:
+			from := s.color
+			to := s.colorFields(c.fields[1:4])
+			duration := parseCount(c.fields[4], c.lineNo)
+			for step := 1; step <= duration; step++ {
+				for i := range s.color {
+					s.color[i] = from[i] + (to[i]-from[i])*step/duration
+				}
+				s.wait(1)
+			}
+		case c.fields[0] == "L":
+			for i := 0; i < parseCount(c.fields[1], c.lineNo); i++ {
+				s.run(c.subCommands)
+			}
+		default:
+			s.t.Fatalf("can't simulate `%s`", c.line())
+		}
+	}
+}
+
+func simulate(t *testing.T, p program) []string {
+	s := simulator{t: t}
+	s.run(p)
+	return s.colors
+}
+
+func TestOptimizeKeepsColors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		depth  int
+	}{
+		{
+			name:   "repeated blinks",
+			source: "C,255,0,0\nD,5\nC,0,0,0\nD,5\nC,255,0,0\nD,5\nC,0,0,0\nD,5\nC,255,0,0\nD,5\nC,0,0,0\nD,5\n",
+		},
+		{
+			name:   "consecutive delays",
+			source: "C,255,0,0\nD,5\nD,7\n\nD,3 ; more\nC,0,0,255\nD,1\n",
+		},
+		{
+			name:   "colors without delay",
+			source: "C,255,0,0\nC,0,255,0\nC,0,255,0\nD,4\nC,0,0,255\nC,0,0,255\nD,4\nTIME,8\nC,255,255,255\nD,2\n",
+		},
+		{
+			name:   "color before ramp",
+			source: "C,255,0,0\nC,0,0,0\nRAMP,255,255,255,10\nC,0,0,0\nRAMP,255,255,255,10\n",
+		},
+		{
+			name:   "loop with ramps",
+			source: "L,3\n\tRAMP,255,0,0,10\n\tRAMP,0,0,0,10\nE\nRAMP,255,0,0,10\nRAMP,0,0,0,10\n",
+		},
+		{
+			name:   "loops with the same body",
+			source: "L,2\n\tC,255,0,0\n\tD,3\n\tC,0,0,0\n\tD,3\nE\nL,3\n\tC,255,0,0\n\tD,3\n\tC,0,0,0\n\tD,3\nE\n",
+		},
+		{
+			name:   "nested loops",
+			source: "L,2\n\tL,3\n\t\tC,255,0,0\n\t\tD,2\n\t\tC,0,0,0\n\t\tD,2\n\tE\n\tC,0,0,255\n\tD,4\nE\nL,3\n\tC,255,0,0\n\tD,2\n\tC,0,0,0\n\tD,2\nE\nC,0,0,255\nD,4\n",
+		},
+		{
+			name:   "nested loops with limited depth",
+			source: "L,2\n\tL,3\n\t\tC,255,0,0\n\t\tD,2\n\t\tC,0,0,0\n\t\tD,2\n\tE\n\tC,0,0,255\n\tD,4\nE\nL,3\n\tC,255,0,0\n\tD,2\n\tC,0,0,0\n\tD,2\nE\nC,0,0,255\nD,4\n",
+			depth:  2,
+		},
+		{
+			name:   "empty loop",
+			source: "C,255,0,0\nL,5\nE\nD,10\n",
+		},
+	}
+
+	for _, test := range tests {
+		opts := options{limits: sizeLimits{depth: test.depth}}
+		unoptimized, err := compileSource(test.source, nil, opts, 0)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		opts.optimize = true
+		optimized, err := compileSource(test.source, nil, opts, 0)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		want := simulate(t, unoptimized)
+		got := simulate(t, optimized)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: optimized program shows\n%v\nbut unoptimized\n%v", test.name, got, want)
+		}
+		if optimized.commandCount() > unoptimized.commandCount() {
+			t.Errorf("%s: optimized program has %d commands, unoptimized %d", test.name, optimized.commandCount(), unoptimized.commandCount())
+		}
+		if test.depth > 0 && optimized.depth() > test.depth {
+			t.Errorf("%s: optimized program is nested %d deep", test.name, optimized.depth())
+		}
+	}
+}
+
+func maxLoopCount(cs []command) int {
+	highest := 0
+	for _, c := range cs {
+		if c.fields[0] == "L" {
+			highest = maxInt(highest, parseCount(c.fields[1], c.lineNo))
+		}
+		highest = maxInt(highest, maxLoopCount(c.subCommands))
+	}
+	return highest
+}
+
+func TestOptimizeKeepsLoopCountLimit(t *testing.T) {
+	source := strings.Repeat("C,255,0,0\nD,1\nC,0,0,255\nD,1\n", 200)
+	for _, limit := range []int{1, 7, 30, 100, 199} {
+		limits := sizeLimits{loopCount: limit}
+		p, err := compileSource(source, nil, options{optimize: true, limits: limits}, 0)
+		if err != nil {
+			t.Errorf("limit %d: %s", limit, err.Error())
+			continue
+		}
+		if count := maxLoopCount(p); count > limit {
+			t.Errorf("limit %d: loop with %d iterations", limit, count)
+		}
+		if duration := commandsDuration(p); duration != 400 {
+			t.Errorf("limit %d: duration %d, want 400", limit, duration)
+		}
+	}
+}
+
+func TestMergeLoopsKeepsLoopCountLimit(t *testing.T) {
+	body := []command{{fields: []string{"C", "255", "0", "0"}}, {fields: []string{"D", "5"}}}
+	loop := func(count string) command {
+		return command{fields: []string{"L", count}, endLine: "E", subCommands: body}
+	}
+	cs := []command{loop("60"), loop("60"), body[0], body[1]}
+
+	merged := mergeLoops(cs, 0)
+	if len(merged) != 1 || merged[0].fields[1] != "121" {
+		t.Errorf("without limit: got %v", programLines(merged))
+	}
+	merged = mergeLoops(cs, 100)
+	if len(merged) != 2 || merged[0].fields[1] != "60" || merged[1].fields[1] != "61" {
+		t.Errorf("with limit 100: got %v", programLines(merged))
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			name:   "overridden colors",
+			source: "C,255,0,0\nC,0,255,0\nC,0,0,255\nD,10\n",
+			want:   "C,0,0,255\nD,10\n",
+		},
+		{
+			name:   "color before ramp",
+			source: "C,255,0,0\nRAMP,0,0,255,10\n",
+			want:   "C,255,0,0\nRAMP,0,0,255,10\n",
+		},
+		{
+			name:   "comments between colors",
+			source: "C,255,0,0 ; red\n\n; now blue\nC,0,0,255\nD,5\n",
+			want:   "\n; now blue\nC,0,0,255\nD,5\n",
+		},
+		{
+			name:   "delays",
+			source: "D,5\nD,7 ; wait\nC,0,0,0\nD,1\nD,2\n",
+			want:   "D,12\nC,0,0,0\nD,3\n",
+		},
+		{
+			name:   "same color again",
+			source: "C,255,0,0\nD,5\nC,255,0,0\nD,5\n",
+			want:   "C,255,0,0\nD,10\n",
+		},
+		{
+			name:   "empty loops",
+			source: "L,3\n; nothing\nE\nL,2\n\tL,4\n\tE\nE\nD,1\n",
+			want:   "D,1\n",
+		},
+	}
+
+	for _, test := range tests {
+		var b strings.Builder
+		parseProgram(strings.NewReader(test.source)).peephole().print(&b)
+		if b.String() != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, b.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// annotation says which commands get a comment with the time after
+// them.
+type annotation int
+
+const (
+	annotateNone annotation = iota
+	annotateTop
+	annotateAll
+)
+
+var annotations = map[string]annotation{
+	"none": annotateNone,
+	"top":  annotateTop,
+	"all":  annotateAll,
+}
+
+var timeFormats = map[string]bool{"cs": true, "mmss": true}
+
+// layout says how commands are laid out in the output.
+type layout int
+
+const (
+	// layoutVerbatim prints commands the compiler didn't change the
+	// way they were in the input, comments and all, and others
+	// without comments or indentation.
+	layoutVerbatim layout = iota
+	// layoutStripped prints only the commands, without comments,
+	// empty lines or indentation.
+	layoutStripped
+	// layoutPretty indents commands by how deeply they're nested and
+	// keeps their comments, even if the compiler changed them.
+	layoutPretty
+)
+
+type printOptions struct {
+	layout layout
+	mode   annotation
+	// timeFormat is "cs" for hundredths of a second, or "mmss" for
+	// minutes, seconds and hundredths.
+	timeFormat string
+	// color is whether to show the club's color.
+	color bool
+}
+
+// sourceMapEntry says where the command in an output line came from.
+type sourceMapEntry struct {
+	line   int
+	time   int
+	lineNo int
+	label  string
+}
+
+// printer writes programs, keeping track of which output line every
+// command ends up in, and of the club's color.
+type printer struct {
+	w       io.Writer
+	line    int
+	entries []sourceMapEntry
+	options printOptions
+	color   string
+}
+
+func newPrinter(w io.Writer, options printOptions) *printer {
+	return &printer{w: w, options: options, color: "0,0,0"}
+}
+
+func (pr *printer) println(text string) {
+	fmt.Fprintln(pr.w, text)
+	pr.line++
+}
+
+func (pr *printer) formatTime(time int) string {
+	if pr.options.timeFormat == "mmss" {
+		return fmt.Sprintf("%d:%02d.%02d", time/6000, time/100%60, time%100)
+	}
+	return fmt.Sprintf("%d", time)
+}
+
+// printAnnotation prints the time at which a command ends.  In loops
+// that's a range from the first to the last iteration, the last one
+// being repeat later.  level is how deeply the command is nested.
+func (pr *printer) printAnnotation(time int, repeat int, level int) {
+	text := "    ; time " + pr.formatTime(time)
+	if pr.options.layout == layoutPretty {
+		text = strings.Repeat("\t", level) + text
+	}
+	if repeat > 0 {
+		text += " to " + pr.formatTime(time+repeat)
+	}
+	if pr.options.color {
+		text += ", color " + pr.color
+	}
+	pr.println(text)
+}
+
+// printLine prints a line of a command, recording it in the source
+// map, unless the layout leaves it out.
+func (pr *printer) printLine(c command, text string, comment string, level int, time int) {
+	switch pr.options.layout {
+	case layoutStripped:
+		if text == "" {
+			return
+		}
+	case layoutPretty:
+		if text != "" {
+			text = strings.Repeat("\t", level) + text
+		}
+		if comment != "" {
+			if text != "" {
+				text += " "
+			}
+			text += "; " + comment
+		}
+	}
+	pr.entries = append(pr.entries, sourceMapEntry{line: pr.line + 1, time: time, lineNo: c.lineNo, label: c.label})
+	pr.println(text)
+}
+
+// printCommand prints a command that starts at time.  Commands in
+// loops are recorded with their time in the first iteration, and
+// `CLUBS` blocks don't move the time of what follows them.  level is
+// how deeply the command is nested, and repeat how much later the last
+// iteration of the loops it's in is than the first.
+func (pr *printer) printCommand(c command, time int, level int, repeat int) {
+	text := strings.Join(c.fields, ",")
+	if pr.options.layout == layoutVerbatim {
+		text = c.line()
+	}
+	pr.printLine(c, text, c.comment, level, time)
+
+	switch {
+	case c.fields[0] == "C" && len(c.fields) == 4:
+		pr.color = strings.Join(c.fields[1:4], ",")
+	case c.fields[0] == "RAMP" && len(c.fields) == 5:
+		pr.color = strings.Join(c.fields[1:4], ",")
+	}
+
+	if c.hasSubCommands() {
+		subTime := time
+		subRepeat := repeat
+		if c.fields[0] == "L" {
+			subRepeat += (parseCount(c.fields[1], c.lineNo) - 1) * commandsSharedDuration(c.subCommands)
+		}
+		for _, sc := range c.subCommands {
+			pr.printCommand(sc, subTime, level+1, subRepeat)
+			subTime += sc.sharedDuration()
+		}
+		endLine := "E"
+		if pr.options.layout == layoutVerbatim {
+			endLine = c.endLine
+		}
+		pr.printLine(c, endLine, lineComment(c.endLine), level, subTime)
+	}
+
+	d := c.duration()
+	if d > 0 && (pr.options.mode == annotateAll || (pr.options.mode == annotateTop && level == 0)) {
+		pr.printAnnotation(time+d, repeat, level)
+	}
+}
+
+func (p program) print(w io.Writer) {
+	p.annotateTimes(w, printOptions{mode: annotateNone})
+}
+
+// annotateTimes prints the program with comments giving the time after
+// commands.  It returns the source map of the output.
+func (p program) annotateTimes(w io.Writer, options printOptions) []sourceMapEntry {
+	pr := newPrinter(w, options)
+	time := 0
+	for _, c := range p {
+		pr.printCommand(c, time, 0, 0)
+		time += c.sharedDuration()
+	}
+	return pr.entries
+}
+
+// writeSourceMap writes one line for every output line with a command,
+// with the output line, the time the command starts at, the input line
+// and the label it came from, separated by tabs.  The input line or the
+// label are empty if the command doesn't come from one.
+func writeSourceMap(w io.Writer, entries []sourceMapEntry, inputName string) {
+	for _, e := range entries {
+		input := ""
+		if e.lineNo != noLine {
+			input = fmt.Sprintf("%s:%d", inputName, e.lineNo+1)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", e.line, e.time, input, e.label)
+	}
+}
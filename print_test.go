@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrettyLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		options printOptions
+		want    string
+	}{
+		{
+			name:    "comments",
+			source:  "C,255,0,0 ; red\nTIME,100 ; jump\nC,0,0,0\n",
+			options: printOptions{layout: layoutPretty},
+			want:    "C,255,0,0 ; red\nD,100 ; jump\nC,0,0,0\n",
+		},
+		{
+			name:    "annotations",
+			source:  "L,2\n  C,255,0,0\n  D,5\nE\n",
+			options: printOptions{layout: layoutPretty, mode: annotateAll},
+			want:    "L,2\n\tC,255,0,0\n\tD,5\n\t    ; time 5 to 10\nE\n    ; time 10\n",
+		},
+	}
+
+	for _, test := range tests {
+		p, err := compileSource(test.source, nil, options{optimize: true}, 0)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		var b strings.Builder
+		p.annotateTimes(&b, test.options)
+		if b.String() != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, b.String(), test.want)
+		}
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	source := "; intro\nC,255,0,0\nL,2\n\tD,5\nE\nCLUBS,1\n\tD,40\nE\nTIME,20\nC,0,0,0\n"
+	p, err := compileSource(source, nil, options{clubs: 2}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var out strings.Builder
+	entries := p.annotateTimes(&out, printOptions{mode: annotateAll})
+	var b strings.Builder
+	writeSourceMap(&b, entries, "show.glo")
+	want := "1\t0\tshow.glo:1\t\n" +
+		"2\t0\tshow.glo:2\t\n" +
+		"3\t0\tshow.glo:3\t\n" +
+		"4\t0\tshow.glo:4\t\n" +
+		"6\t5\tshow.glo:3\t\n" +
+		"8\t10\tshow.glo:6\t\n" +
+		"9\t10\tshow.glo:7\t\n" +
+		"11\t50\tshow.glo:6\t\n" +
+		"13\t10\tshow.glo:9\t\n" +
+		"15\t20\tshow.glo:10\t\n"
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s\nfor\n%s", b.String(), want, out.String())
+	}
+}
+
+func TestSourceMapLabels(t *testing.T) {
+	entries := []sourceMapEntry{
+		{line: 1, time: 0, lineNo: noLine},
+		{line: 2, time: 100, lineNo: noLine, label: "verse 1"},
+		{line: 5, time: 150, lineNo: 2, label: "verse 1"},
+	}
+	var b strings.Builder
+	writeSourceMap(&b, entries, "show.glo")
+	want := "1\t0\t\t\n2\t100\t\tverse 1\n5\t150\tshow.glo:3\tverse 1\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	source := "C,255,0,0\nD,6000\nL,2\n\tL,3\n\t\tRAMP,0,0,255,5\n\tE\n\tD,10\nE\n"
+	tests := []struct {
+		name    string
+		options printOptions
+		want    string
+	}{
+		{
+			name:    "none",
+			options: printOptions{mode: annotateNone},
+			want:    "C,255,0,0|D,6000|L,2|L,3|RAMP,0,0,255,5|\tE|D,10|E",
+		},
+		{
+			name:    "top",
+			options: printOptions{mode: annotateTop},
+			want:    "C,255,0,0|D,6000|    ; time 6000|L,2|L,3|RAMP,0,0,255,5|\tE|D,10|E|    ; time 6050",
+		},
+		{
+			name:    "all",
+			options: printOptions{mode: annotateAll},
+			want: "C,255,0,0|D,6000|    ; time 6000|L,2|L,3|RAMP,0,0,255,5|    ; time 6005 to 6040|\tE|    ; time 6015 to 6040|" +
+				"D,10|    ; time 6025 to 6050|E|    ; time 6050",
+		},
+		{
+			name:    "minutes and seconds",
+			options: printOptions{mode: annotateTop, timeFormat: "mmss"},
+			want:    "C,255,0,0|D,6000|    ; time 1:00.00|L,2|L,3|RAMP,0,0,255,5|\tE|D,10|E|    ; time 1:00.50",
+		},
+		{
+			name:    "colors",
+			options: printOptions{mode: annotateTop, color: true},
+			want:    "C,255,0,0|D,6000|    ; time 6000, color 255,0,0|L,2|L,3|RAMP,0,0,255,5|\tE|D,10|E|    ; time 6050, color 0,0,255",
+		},
+	}
+
+	p, err := compileSource(source, nil, options{}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		p.annotateTimes(&b, test.options)
+		got := strings.ReplaceAll(strings.TrimSuffix(b.String(), "\n"), "\n", "|")
+		if got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	source := "; Intro\nC,255,0,0   ; red\n\nL,2 ; twice\n  C,0,0,255\n  D,5\nE ; loop\nC,0,0,0\n"
+	tests := []struct {
+		layout layout
+		want   string
+	}{
+		{layoutVerbatim, "; Intro\nC,255,0,0   ; red\n\nL,2\n  C,0,0,255\nD,5\nE ; loop\nC,0,0,0\n"},
+		{layoutStripped, "C,255,0,0\nL,2\nC,0,0,255\nD,5\nE\nC,0,0,0\n"},
+		{layoutPretty, "; Intro\nC,255,0,0 ; red\n\nL,2 ; twice\n\tC,0,0,255\n\tD,5\nE ; loop\nC,0,0,0\n"},
+	}
+
+	p, err := compileSource(source, nil, options{}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		entries := p.annotateTimes(&b, printOptions{layout: test.layout})
+		if b.String() != test.want {
+			t.Errorf("layout %d: got\n%s\nwant\n%s", test.layout, b.String(), test.want)
+		}
+		if lines := strings.Count(b.String(), "\n"); len(entries) != lines {
+			t.Errorf("layout %d: %d source map entries for %d lines", test.layout, len(entries), lines)
+		}
+	}
+}
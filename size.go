@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// sizeLimits are the limits of the clubs' firmware.  Zero means no
+// limit.
+type sizeLimits struct {
+	commands  int
+	depth     int
+	loopCount int
+}
+
+// isEmptyLine is whether a command is just an empty line or a comment,
+// which doesn't take up memory in the club.
+func (c *command) isEmptyLine() bool {
+	return len(c.fields) == 1 && c.fields[0] == ""
+}
+
+// commandCount is the number of commands the club has to store,
+// including the `E` that ends a block.
+func (c *command) commandCount() int {
+	if c.isEmptyLine() {
+		return 0
+	}
+	count := 1
+	if c.hasSubCommands() {
+		count += program(c.subCommands).commandCount() + 1
+	}
+	return count
+}
+
+func (p program) commandCount() int {
+	count := 0
+	for _, c := range p {
+		count += c.commandCount()
+	}
+	return count
+}
+
+func (p program) depth() int {
+	depth := 0
+	for _, c := range p {
+		if c.hasSubCommands() {
+			depth = maxInt(depth, program(c.subCommands).depth()+1)
+		}
+	}
+	return depth
+}
+
+func (p program) checkLoopCounts(limit int) []string {
+	var problems []string
+	for _, c := range p {
+		if c.fields[0] == "L" {
+			count := parseCount(c.fields[1], c.lineNo)
+			if count > limit {
+				problems = append(problems, fmt.Sprintf("Loop from %s has %d iterations, but the maximum is %d", c.origin(), count, limit))
+			}
+		}
+		if c.hasSubCommands() {
+			problems = append(problems, program(c.subCommands).checkLoopCounts(limit)...)
+		}
+	}
+	return problems
+}
+
+// checkSize returns a description of every limit the program exceeds.
+func (p program) checkSize(limits sizeLimits) []string {
+	var problems []string
+	if limits.commands > 0 {
+		count := p.commandCount()
+		if count > limits.commands {
+			problems = append(problems, fmt.Sprintf("Program has %d commands, but the maximum is %d", count, limits.commands))
+		}
+	}
+	if limits.depth > 0 {
+		depth := p.depth()
+		if depth > limits.depth {
+			problems = append(problems, fmt.Sprintf("Loops are nested %d deep, but the maximum is %d", depth, limits.depth))
+		}
+	}
+	if limits.loopCount > 0 {
+		problems = append(problems, p.checkLoopCounts(limits.loopCount)...)
+	}
+	return problems
+}
+
+type programSection struct {
+	origin   string
+	start    int
+	end      int
+	commands int
+	depth    int
+}
+
+// sections groups the top-level commands of the program by where they
+// came from, which is `generated` or the label for commands that aren't
+// from the input.  A `CLUBS` block's section covers the block, but
+// doesn't move the time of the next one.
+func (p program) sections() []programSection {
+	var sections []programSection
+	time := 0
+	for _, c := range p {
+		if c.isEmptyLine() {
+			continue
+		}
+		if len(sections) == 0 || sections[len(sections)-1].origin != c.origin() {
+			sections = append(sections, programSection{origin: c.origin(), start: time, end: time})
+		}
+		s := &sections[len(sections)-1]
+		s.end = maxInt(s.end, time+c.duration())
+		time += c.sharedDuration()
+		s.commands += c.commandCount()
+		s.depth = maxInt(s.depth, program([]command{c}).depth())
+	}
+	return sections
+}
+
+type sectionsBySize []programSection
+
+func (ss sectionsBySize) Len() int {
+	return len(ss)
+}
+
+func (ss sectionsBySize) Less(i, j int) bool {
+	return ss[i].commands > ss[j].commands
+}
+
+func (ss sectionsBySize) Swap(i, j int) {
+	ss[i], ss[j] = ss[j], ss[i]
+}
+
+const maxSectionsInBreakdown = 10
+
+// printSizeBreakdown prints the sections of the program that take up
+// the most commands.
+func (p program) printSizeBreakdown(w io.Writer) {
+	sections := p.sections()
+	sort.Stable(sectionsBySize(sections))
+	if len(sections) > maxSectionsInBreakdown {
+		sections = sections[0:maxSectionsInBreakdown]
+	}
+
+	fmt.Fprintf(w, "%d commands in total, largest sections:\n", p.commandCount())
+	for _, s := range sections {
+		fmt.Fprintf(w, "    %s, time %d to %d: size %d, depth %d\n", s.origin, s.start, s.end, s.commands, s.depth)
+	}
+}
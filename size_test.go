@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSections(t *testing.T) {
+	p := program{
+		{fields: []string{"C", "0", "0", "0"}, lineNo: noLine},
+		{fields: []string{"D", "10"}, lineNo: noLine, label: "intro"},
+		{fields: []string{"C", "255", "0", "0"}, lineNo: 3, label: "intro"},
+		{fields: []string{"D", "5"}, lineNo: 3, label: "intro"},
+		{fields: []string{""}, lineNo: 4},
+		{fields: []string{"CLUBS", "1"}, lineNo: 5, endLine: "E", subCommands: []command{
+			{fields: []string{"D", "20"}, lineNo: 6}}},
+		{fields: []string{"D", "7"}, lineNo: 8},
+	}
+
+	want := []string{
+		"generated 0-0 1/0",
+		"label `intro` 0-10 1/0",
+		"line 4 for label `intro` 10-15 2/0",
+		"line 6 15-35 3/1",
+		"line 9 15-22 1/0",
+	}
+	sections := p.sections()
+	if len(sections) != len(want) {
+		t.Fatalf("got %d sections, want %d: %v", len(sections), len(want), sections)
+	}
+	for i, s := range sections {
+		got := fmt.Sprintf("%s %d-%d %d/%d", s.origin, s.start, s.end, s.commands, s.depth)
+		if got != want[i] {
+			t.Errorf("section %d: got `%s`, want `%s`", i, got, want[i])
+		}
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	p := program{
+		{fields: []string{"L", "300"}, lineNo: 2, endLine: "E", subCommands: []command{
+			{fields: []string{"L", "2"}, lineNo: noLine, label: "solo", endLine: "E", subCommands: []command{
+				{fields: []string{"D", "1"}, lineNo: noLine, label: "solo"}}}}},
+	}
+
+	tests := []struct {
+		limits sizeLimits
+		want   []string
+	}{
+		{sizeLimits{}, nil},
+		{sizeLimits{commands: 5, depth: 2, loopCount: 300}, nil},
+		{sizeLimits{commands: 4}, []string{"Program has 5 commands, but the maximum is 4"}},
+		{sizeLimits{depth: 1}, []string{"Loops are nested 2 deep, but the maximum is 1"}},
+		{sizeLimits{loopCount: 1}, []string{
+			"Loop from line 3 has 300 iterations, but the maximum is 1",
+			"Loop from label `solo` has 2 iterations, but the maximum is 1"}},
+	}
+
+	for _, test := range tests {
+		got := p.checkSize(test.limits)
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("%+v: got %q, want %q", test.limits, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// How often we look at the files, and how long they have to stay
+// unchanged before we recompile, since editors and Audacity often
+// write a file in several steps.
+const (
+	watchInterval = 250 * time.Millisecond
+	watchDebounce = 500 * time.Millisecond
+)
+
+const maxTimingChanges = 10
+
+func (opts options) watchedFiles() []string {
+	var paths []string
+	for _, path := range []string{opts.input, opts.audacity, opts.audio} {
+		if path != "" && path != "-" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// fileStamps identifies the versions of files, so we can tell when
+// they change.  Files that don't exist get an empty stamp.
+func fileStamps(paths []string) map[string]string {
+	stamps := make(map[string]string)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil {
+			stamps[path] = fmt.Sprintf("%d %d", info.ModTime().UnixNano(), info.Size())
+		} else {
+			stamps[path] = ""
+		}
+	}
+	return stamps
+}
+
+func stampsEqual(a map[string]string, b map[string]string) bool {
+	for path, stamp := range a {
+		if b[path] != stamp {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+// sectionKeys names the sections of a program by their origin, with
+// repeated origins numbered.
+func sectionKeys(sections []programSection) []string {
+	var keys []string
+	seen := make(map[string]int)
+	for _, s := range sections {
+		seen[s.origin]++
+		key := s.origin
+		if seen[s.origin] > 1 {
+			key = fmt.Sprintf("%s (%d)", s.origin, seen[s.origin])
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// timingChanges describes how the sections of a program moved in time
+// from one compile to the next.
+func timingChanges(oldProgram program, newProgram program) []string {
+	oldSections := oldProgram.sections()
+	oldKeys := sectionKeys(oldSections)
+	oldByKey := make(map[string]programSection)
+	for i, s := range oldSections {
+		oldByKey[oldKeys[i]] = s
+	}
+
+	var changes []string
+	newSections := newProgram.sections()
+	for i, key := range sectionKeys(newSections) {
+		s := newSections[i]
+		old, ok := oldByKey[key]
+		delete(oldByKey, key)
+		if !ok {
+			changes = append(changes, fmt.Sprintf("%s: new at %d to %d", key, s.start, s.end))
+		} else if old.start != s.start || old.end != s.end {
+			changes = append(changes, fmt.Sprintf("%s: %d to %d, was %d to %d", key, s.start, s.end, old.start, old.end))
+		}
+	}
+	for _, key := range oldKeys {
+		if s, ok := oldByKey[key]; ok {
+			changes = append(changes, fmt.Sprintf("%s: gone, was %d to %d", key, s.start, s.end))
+		}
+	}
+
+	oldDuration := commandsDuration(oldProgram)
+	newDuration := commandsDuration(newProgram)
+	if oldDuration != newDuration {
+		changes = append(changes, fmt.Sprintf("total duration %d, was %d", newDuration, oldDuration))
+	}
+	return changes
+}
+
+func printTimingChanges(opts options, oldPrograms map[int]program, newPrograms map[int]program) {
+	for _, club := range opts.compiledClubs() {
+		name := "program"
+		if club != 0 {
+			name = fmt.Sprintf("club %d", club)
+		}
+
+		oldProgram, ok := oldPrograms[club]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: %d commands, duration %d\n", name, newPrograms[club].commandCount(), commandsDuration(newPrograms[club]))
+			continue
+		}
+
+		changes := timingChanges(oldProgram, newPrograms[club])
+		if len(changes) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: timing unchanged\n", name)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: timing changed\n", name)
+		for i, change := range changes {
+			if i == maxTimingChanges {
+				fmt.Fprintf(os.Stderr, "    ... and %d more\n", len(changes)-i)
+				break
+			}
+			fmt.Fprintf(os.Stderr, "    %s\n", change)
+		}
+	}
+}
+
+// rebuild compiles and writes all programs and reports how their
+// timing changed.  If that fails, it returns the previous programs, so
+// the next report compares against the last good compile.
+func rebuild(opts options, previous map[int]program) map[int]program {
+	programs, err := compileAll(opts)
+	if err == nil {
+		err = writePrograms(opts, programs)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return previous
+	}
+	printTimingChanges(opts, previous, programs)
+	return programs
+}
+
+// watch recompiles whenever one of the input files changes, until
+// it's interrupted.
+func watch(opts options) {
+	paths := opts.watchedFiles()
+	fmt.Fprintf(os.Stderr, "Watching %v\n", paths)
+
+	stamps := fileStamps(paths)
+	programs := rebuild(opts, nil)
+	for {
+		time.Sleep(watchInterval)
+		newStamps := fileStamps(paths)
+		if stampsEqual(stamps, newStamps) {
+			continue
+		}
+		for {
+			time.Sleep(watchDebounce)
+			settledStamps := fileStamps(paths)
+			if stampsEqual(newStamps, settledStamps) {
+				break
+			}
+			newStamps = settledStamps
+		}
+		stamps = newStamps
+
+		fmt.Fprintf(os.Stderr, "Recompiling at %s\n", time.Now().Format("15:04:05"))
+		programs = rebuild(opts, programs)
+	}
+}
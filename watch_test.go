@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWatchedFiles(t *testing.T) {
+	opts := options{input: "-", audacity: "show.aup", audio: ""}
+	if got := fmt.Sprint(opts.watchedFiles()); got != "[show.aup]" {
+		t.Errorf("got %s", got)
+	}
+	opts = options{input: "show.glo", audacity: "show.aup", audio: "show.wav"}
+	if got := fmt.Sprint(opts.watchedFiles()); got != "[show.glo show.aup show.wav]" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestFileStamps(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "show.glo")
+	missing := filepath.Join(dir, "missing.glo")
+	if err := os.WriteFile(path, []byte("D,10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := fileStamps([]string{path, missing})
+	if before[path] == "" || before[missing] != "" {
+		t.Fatalf("got stamps %v", before)
+	}
+	if !stampsEqual(before, fileStamps([]string{path, missing})) {
+		t.Errorf("stamps changed without changing the files")
+	}
+
+	if err := os.WriteFile(path, []byte("D,100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if stampsEqual(before, fileStamps([]string{path, missing})) {
+		t.Errorf("stamps didn't change with the file's size")
+	}
+	if stampsEqual(before, fileStamps([]string{path})) {
+		t.Errorf("stamps are equal without the missing file")
+	}
+}
+
+func TestSectionKeys(t *testing.T) {
+	sections := []programSection{{origin: "generated"}, {origin: "line 3"}, {origin: "generated"}, {origin: "generated"}}
+	want := "generated|line 3|generated (2)|generated (3)"
+	if got := strings.Join(sectionKeys(sections), "|"); got != want {
+		t.Errorf("got `%s`, want `%s`", got, want)
+	}
+}
+
+func TestTimingChanges(t *testing.T) {
+	compile := func(source string) program {
+		p, err := compileSource(source, nil, options{}, 0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return p
+	}
+	old := compile("C,255,0,0\nD,10\nC,0,0,255\nD,20\nC,0,0,0\n")
+
+	if changes := timingChanges(old, old); len(changes) != 0 {
+		t.Errorf("unchanged program: got %v", changes)
+	}
+
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{
+			"C,255,0,0\nD,15\nC,0,0,255\nD,20\nC,0,0,0\n",
+			[]string{"line 2: 0 to 15, was 0 to 10", "line 3: 15 to 15, was 10 to 10", "line 4: 15 to 35, was 10 to 30", "line 5: 35 to 35, was 30 to 30", "total duration 35, was 30"},
+		},
+		{
+			"C,255,0,0\nD,10\nC,0,0,255\nD,20\n",
+			[]string{"line 5: gone, was 30 to 30"},
+		},
+		{
+			"C,255,0,0\nD,10\nC,0,0,255\nD,20\nC,0,0,0\nD,5\n",
+			[]string{"line 6: new at 30 to 35", "total duration 35, was 30"},
+		},
+	}
+	for _, test := range tests {
+		got := timingChanges(old, compile(test.source))
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("%q: got\n%q\nwant\n%q", test.source, got, test.want)
+		}
+	}
+}